@@ -0,0 +1,105 @@
+// Command backfill-phones rewrites stored phone numbers into the E.164 form
+// the server has normalized new input to since phone normalization was added.
+// It uses the same STORAGE_DRIVER and DEFAULT_PHONE_REGION settings as the
+// server and updates numbers through the repository, so the phone lookup
+// moves along with each user. Numbers that cannot be parsed, or that collide
+// with another user once normalized, are reported and left for manual review.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"2k4sm/grpc-crud/src/models"
+	"2k4sm/grpc-crud/src/phone"
+	"2k4sm/grpc-crud/src/repositories"
+	"2k4sm/grpc-crud/src/storage"
+
+	"github.com/joho/godotenv"
+)
+
+const (
+	pageSize = 500
+	// actor is recorded as updated_by on the users this command rewrites.
+	actor = "backfill-phones"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "report the changes without writing them")
+	flag.Parse()
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file, using default variables.")
+	}
+
+	defaultRegion := os.Getenv("DEFAULT_PHONE_REGION")
+	if defaultRegion == "" {
+		defaultRegion = "IN"
+	}
+
+	phones, err := phone.NewNormalizer(defaultRegion)
+	if err != nil {
+		log.Fatalln("Invalid DEFAULT_PHONE_REGION:", err)
+	}
+
+	userRepo, closeRepo := storage.OpenUserRepository()
+	defer closeRepo()
+
+	ctx := context.Background()
+	var rewritten, invalid, collisions, conflicts int
+
+	// Deleted users are rewritten too, so that they come back normalized
+	// when restored.
+	err = repositories.EachUser(ctx, userRepo, pageSize, func(user *models.User) {
+		normalized, err := phones.Normalize(user.PhNumber)
+		if err != nil {
+			log.Printf("User %s (%s): cannot normalize %q: %v", user.ID, user.Email, user.PhNumber, err)
+			invalid++
+			return
+		}
+
+		if normalized == user.PhNumber {
+			return
+		}
+
+		if *dryRun {
+			log.Printf("User %s (%s): would rewrite %q to %q", user.ID, user.Email, user.PhNumber, normalized)
+			rewritten++
+			return
+		}
+
+		updated := *user
+		updated.PhNumber = normalized
+
+		applied, err := userRepo.UpdateUser(ctx, &updated, []string{"ph_number"}, modification(), user.Version)
+		if errors.Is(err, repositories.ErrPhoneTaken) {
+			log.Printf("User %s (%s): %q normalizes to %q, which belongs to another user", user.ID, user.Email, user.PhNumber, normalized)
+			collisions++
+			return
+		}
+		if err != nil {
+			log.Fatalf("Failed to update user %s: %v", user.ID, err)
+		}
+		if !applied {
+			log.Printf("User %s (%s): modified while backfilling, rerun to pick it up", user.ID, user.Email)
+			conflicts++
+			return
+		}
+
+		log.Printf("User %s (%s): rewrote %q to %q", user.ID, user.Email, user.PhNumber, normalized)
+		rewritten++
+	})
+	if err != nil {
+		log.Fatalln("Failed to list users:", err)
+	}
+
+	log.Printf("Phone backfill finished: %d rewritten, %d invalid, %d collisions, %d modified concurrently", rewritten, invalid, collisions, conflicts)
+}
+
+func modification() models.Modification {
+	return models.Modification{At: time.Now().UTC().Truncate(time.Millisecond), By: actor}
+}
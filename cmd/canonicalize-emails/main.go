@@ -0,0 +1,135 @@
+// Command canonicalize-emails rewrites stored emails into the canonical form
+// the server has looked users up by since email canonicalization was added,
+// keeping the stored address as the display form. The local part is
+// lowercased too, so users whose emails only differ in case, even in the
+// local part (or, with EMAIL_PROVIDER_RULES, in Gmail dots and "+tags")
+// collide once canonicalized; they are reported and left untouched, since
+// deciding which account to keep needs a person. It uses the same
+// STORAGE_DRIVER and EMAIL_PROVIDER_RULES settings as the server.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"2k4sm/grpc-crud/src/email"
+	"2k4sm/grpc-crud/src/models"
+	"2k4sm/grpc-crud/src/repositories"
+	"2k4sm/grpc-crud/src/storage"
+
+	"github.com/joho/godotenv"
+)
+
+const (
+	pageSize = 500
+	// actor is recorded as updated_by on the users this command rewrites.
+	actor = "canonicalize-emails"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "report collisions and changes without writing them")
+	flag.Parse()
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file, using default variables.")
+	}
+
+	emails := email.NewCanonicalizer(os.Getenv("EMAIL_PROVIDER_RULES") == "true")
+
+	userRepo, closeRepo := storage.OpenUserRepository()
+	defer closeRepo()
+
+	ctx := context.Background()
+
+	log.Println("Canonicalizing emails: local parts are lowercased, so addresses that only differ in case, such as Alice@example.com and alice@example.com, name one account")
+
+	// The first pass counts the users behind every canonical email, so that
+	// no user is rewritten onto an address another user will also map to.
+	owners := map[string]int{}
+	eachUser(ctx, userRepo, func(user *models.User) {
+		if canonical, err := emails.Canonicalize(user.Email); err == nil {
+			owners[canonical]++
+		}
+	})
+
+	var rewritten, invalid, conflicts int
+	collisions := map[string][]string{}
+
+	eachUser(ctx, userRepo, func(user *models.User) {
+		canonical, err := emails.Canonicalize(user.Email)
+		if err != nil {
+			log.Printf("User %s: cannot canonicalize %q: %v", user.ID, user.Email, err)
+			invalid++
+			return
+		}
+
+		if owners[canonical] > 1 {
+			collisions[canonical] = append(collisions[canonical], user.ID.String()+" ("+user.Email+")")
+			return
+		}
+
+		if canonical == user.Email {
+			return
+		}
+
+		if *dryRun {
+			log.Printf("User %s: would rewrite %q to %q", user.ID, user.Email, canonical)
+			rewritten++
+			return
+		}
+
+		displayEmail := user.DisplayEmail
+		if displayEmail == "" {
+			displayEmail = user.Email
+		}
+
+		_, err = userRepo.ChangeEmail(ctx, user, canonical, displayEmail, "", modification())
+		if errors.Is(err, repositories.ErrEmailTaken) {
+			collisions[canonical] = append(collisions[canonical], user.ID.String()+" ("+user.Email+"), created while canonicalizing")
+			return
+		}
+		if errors.Is(err, repositories.ErrVersionConflict) {
+			log.Printf("User %s (%s): modified while canonicalizing, rerun to pick it up", user.ID, user.Email)
+			conflicts++
+			return
+		}
+		if err != nil {
+			log.Fatalf("Failed to change email of user %s: %v", user.ID, err)
+		}
+
+		log.Printf("User %s: rewrote %q to %q", user.ID, user.Email, canonical)
+		rewritten++
+	})
+
+	canonicals := make([]string, 0, len(collisions))
+	for canonical := range collisions {
+		canonicals = append(canonicals, canonical)
+	}
+	sort.Strings(canonicals)
+
+	for _, canonical := range canonicals {
+		log.Printf("Collision on %s, these users would be merged into one account:", canonical)
+		for _, user := range collisions[canonical] {
+			log.Printf("  %s", user)
+		}
+	}
+
+	log.Printf("Email canonicalization finished: %d rewritten, %d invalid, %d collisions, %d modified concurrently", rewritten, invalid, len(canonicals), conflicts)
+}
+
+// eachUser visits deleted users too, so that they come back canonicalized
+// when restored and count towards collisions while their email is reserved.
+func eachUser(ctx context.Context, userRepo repositories.UserRepository, fn func(user *models.User)) {
+	if err := repositories.EachUser(ctx, userRepo, pageSize, fn); err != nil {
+		log.Fatalln("Failed to list users:", err)
+	}
+}
+
+func modification() models.Modification {
+	return models.Modification{At: time.Now().UTC().Truncate(time.Millisecond), By: actor}
+}
@@ -6,17 +6,23 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/joho/godotenv"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 
 	userspb "2k4sm/grpc-crud/proto/users"
-	"2k4sm/grpc-crud/src/db"
-	"2k4sm/grpc-crud/src/repositories"
+	"2k4sm/grpc-crud/src/email"
+	"2k4sm/grpc-crud/src/phone"
 	"2k4sm/grpc-crud/src/services"
+	"2k4sm/grpc-crud/src/storage"
 )
 
 func main() {
@@ -26,18 +32,42 @@ func main() {
 		log.Println("No .env file, using default variables.")
 	}
 
-	session := db.InitDb()
-	defer session.Close()
+	userRepo, closeRepo := storage.OpenUserRepository()
+	defer closeRepo()
+
+	defaultRegion := os.Getenv("DEFAULT_PHONE_REGION")
+	if defaultRegion == "" {
+		defaultRegion = "IN"
+	}
+
+	phones, err := phone.NewNormalizer(defaultRegion)
+	if err != nil {
+		log.Fatalln("Invalid DEFAULT_PHONE_REGION:", err)
+	}
+
+	emails := email.NewCanonicalizer(os.Getenv("EMAIL_PROVIDER_RULES") == "true")
+
+	accessExpiryInterval := durationEnv("ACCESS_EXPIRY_INTERVAL", time.Minute)
+	deletedUserRetention := durationEnv("DELETED_USER_RETENTION", 30*24*time.Hour)
+	userPurgeInterval := durationEnv("USER_PURGE_INTERVAL", time.Hour)
+
+	if err := userRepo.ResumeEmailChanges(context.Background()); err != nil {
+		log.Println("Failed to resume pending email changes:", err)
+	}
 
 	lis, err := net.Listen("tcp", ":8080")
 	if err != nil {
 		log.Fatalln("Failed to listen:", err)
 	}
 
-	grpcServer := grpc.NewServer()
-	userRepo := repositories.NewUserRepository(session)
-	userService := services.NewUserService(userRepo)
+	grpcServer := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(services.UnaryValidationInterceptor),
+		grpc.ChainStreamInterceptor(services.StreamValidationInterceptor),
+	)
+	userService := services.NewUserService(userRepo, phones, emails, deletedUserRetention)
 	userspb.RegisterUsersServer(grpcServer, userService)
+	go userService.RunAccessExpiry(context.Background(), accessExpiryInterval)
+	go userService.RunPurge(context.Background(), userPurgeInterval)
 
 	log.Println("Serving gRPC on localhost:8080")
 	go func() {
@@ -52,7 +82,10 @@ func main() {
 		log.Fatalln("Failed to dial server:", err)
 	}
 
-	mux := runtime.NewServeMux()
+	mux := runtime.NewServeMux(
+		runtime.WithIncomingHeaderMatcher(headerMatcher),
+		runtime.WithErrorHandler(errorHandler),
+	)
 	mux.HandlePath("GET", "/", func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
@@ -83,3 +116,94 @@ func main() {
 	log.Println("Serving gRPC-Gateway on http://localhost:6969")
 	log.Fatalln(httpServer.ListenAndServe())
 }
+
+// headerMatcher forwards If-Match for conditional writes and X-Actor, which
+// names the caller recorded as created_by and updated_by.
+func headerMatcher(key string) (string, bool) {
+	switch http.CanonicalHeaderKey(key) {
+	case "If-Match":
+		return "if-match", true
+	case "X-Actor":
+		return "x-actor", true
+	}
+	return runtime.DefaultHeaderMatcher(key)
+}
+
+// errorHandler reports failed version preconditions as 412 instead of the
+// default 400 so that If-Match callers get standard HTTP semantics, turns a
+// RetryInfo detail into a Retry-After header and renders validation failures
+// with a flat list of field violations.
+func errorHandler(ctx context.Context, mux *runtime.ServeMux, marshaler runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	st := status.Convert(err)
+
+	if st.Code() == codes.FailedPrecondition {
+		w = &statusOverrideWriter{ResponseWriter: w, status: http.StatusPreconditionFailed}
+	}
+
+	for _, detail := range st.Details() {
+		switch detail := detail.(type) {
+		case *errdetails.RetryInfo:
+			seconds := int((detail.GetRetryDelay().AsDuration() + time.Second - 1) / time.Second)
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		case *errdetails.BadRequest:
+			writeValidationError(w, st, detail)
+			return
+		}
+	}
+
+	runtime.DefaultHTTPErrorHandler(ctx, mux, marshaler, w, r, err)
+}
+
+type fieldViolation struct {
+	Field       string `json:"field"`
+	Description string `json:"description"`
+}
+
+type validationError struct {
+	Code            int32            `json:"code"`
+	Message         string           `json:"message"`
+	FieldViolations []fieldViolation `json:"fieldViolations"`
+}
+
+func writeValidationError(w http.ResponseWriter, st *status.Status, badRequest *errdetails.BadRequest) {
+	body := validationError{
+		Code:    int32(st.Code()),
+		Message: st.Message(),
+	}
+	for _, violation := range badRequest.GetFieldViolations() {
+		body.FieldViolations = append(body.FieldViolations, fieldViolation{
+			Field:       violation.GetField(),
+			Description: violation.GetDescription(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(runtime.HTTPStatusFromCode(st.Code()))
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Println("Failed to write validation error:", err)
+	}
+}
+
+type statusOverrideWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusOverrideWriter) WriteHeader(int) {
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+// durationEnv reads a positive duration such as "90s" or "720h" from the
+// environment variable name, or returns fallback when it is unset.
+func durationEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Fatalf("Invalid %s: %s", name, value)
+	}
+	return duration
+}
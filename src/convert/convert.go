@@ -0,0 +1,224 @@
+// Package convert maps between the stored models and their protobuf
+// representation. Every RPC builds its messages here, so a field added to
+// models.User only needs to be mapped once. Enum mappings are total: a value
+// without a counterpart on the other side is reported as an error instead of
+// being replaced by a default.
+package convert
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	userspb "2k4sm/grpc-crud/proto/users"
+	"2k4sm/grpc-crud/src/models"
+
+	"google.golang.org/genproto/googleapis/type/date"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	ErrUnknownEnum = errors.New("unknown enum value")
+	ErrInvalidDate = errors.New("not a calendar date")
+)
+
+// genders and accesses map every proto enum value to the string it is stored
+// as. init checks that no value of the generated enums is missing, so a new
+// enum value cannot be released without deciding how it is stored.
+//
+// Genders are stored by name, so the stored form does not depend on enum
+// numbers. The same holds for access states.
+var genders = map[userspb.Gender]string{
+	userspb.Gender_MALE:               "MALE",
+	userspb.Gender_FEMALE:             "FEMALE",
+	userspb.Gender_NON_BINARY:         "NON_BINARY",
+	userspb.Gender_OTHER:              "OTHER",
+	userspb.Gender_PREFER_NOT_TO_SAY:  "PREFER_NOT_TO_SAY",
+	userspb.Gender_GENDER_UNSPECIFIED: "GENDER_UNSPECIFIED",
+}
+
+var accesses = map[userspb.Access]string{
+	userspb.Access_BLOCKED:            "BLOCKED",
+	userspb.Access_UNBLOCKED:          "UNBLOCKED",
+	userspb.Access_SUSPENDED:          "SUSPENDED",
+	userspb.Access_LOCKED:             "LOCKED",
+	userspb.Access_DEACTIVATED:        "DEACTIVATED",
+	userspb.Access_ACCESS_UNSPECIFIED: "ACCESS_UNSPECIFIED",
+}
+
+var (
+	gendersByName  = invert(genders)
+	accessesByName = invert(accesses)
+)
+
+func init() {
+	for value, name := range userspb.Gender_name {
+		if _, ok := genders[userspb.Gender(value)]; !ok {
+			panic(fmt.Sprintf("convert: gender %s has no stored form", name))
+		}
+	}
+
+	for value, name := range userspb.Access_name {
+		if _, ok := accesses[userspb.Access(value)]; !ok {
+			panic(fmt.Sprintf("convert: access %s has no stored form", name))
+		}
+	}
+}
+
+func GenderToProto(gender string) (userspb.Gender, error) {
+	value, ok := gendersByName[gender]
+	if !ok {
+		return 0, fmt.Errorf("%w: gender %q", ErrUnknownEnum, gender)
+	}
+	return value, nil
+}
+
+func GenderFromProto(gender userspb.Gender) (string, error) {
+	name, ok := genders[gender]
+	if !ok {
+		return "", fmt.Errorf("%w: gender %d", ErrUnknownEnum, gender)
+	}
+	return name, nil
+}
+
+func AccessToProto(access string) (userspb.Access, error) {
+	value, ok := accessesByName[access]
+	if !ok {
+		return 0, fmt.Errorf("%w: access %q", ErrUnknownEnum, access)
+	}
+	return value, nil
+}
+
+func AccessFromProto(access userspb.Access) (string, error) {
+	name, ok := accesses[access]
+	if !ok {
+		return "", fmt.Errorf("%w: access %d", ErrUnknownEnum, access)
+	}
+	return name, nil
+}
+
+// Genders returns the stored form of every gender, in enum order.
+func Genders() []string {
+	return names(genders)
+}
+
+// Accesses returns the stored form of every access state, in enum order.
+func Accesses() []string {
+	return names(accesses)
+}
+
+// UserToProto converts a stored user for a response. It fails if the stored
+// gender or access is not one the API knows.
+func UserToProto(user *models.User) (*userspb.UserResponse, error) {
+	gender, err := GenderToProto(user.Gender)
+	if err != nil {
+		return nil, err
+	}
+
+	access, err := AccessToProto(user.Access)
+	if err != nil {
+		return nil, err
+	}
+
+	return &userspb.UserResponse{
+		Id:              user.ID.String(),
+		Email:           user.Email,
+		DisplayEmail:    displayEmail(user),
+		FirstName:       user.FirstName,
+		LastName:        user.LastName,
+		PhNumber:        user.PhNumber,
+		Gender:          gender,
+		Dob:             user.Dob.Format(time.RFC3339),
+		BirthDate:       DateToProto(user.Dob),
+		Access:          access,
+		AccessExpiresAt: TimestampToProto(user.AccessExpiresAt),
+		Version:         user.Version,
+		CreatedAt:       TimestampToProto(user.CreatedAt),
+		UpdatedAt:       TimestampToProto(user.UpdatedAt),
+		CreatedBy:       user.CreatedBy,
+		UpdatedBy:       user.UpdatedBy,
+		DeletedAt:       TimestampToProto(user.DeletedAt),
+		DeletedBy:       user.DeletedBy,
+	}, nil
+}
+
+// AccessChangeToProto converts an entry of the access history. It fails if
+// either access state is not one the API knows.
+func AccessChangeToProto(change *models.AccessChange) (*userspb.AccessChange, error) {
+	access, err := AccessToProto(change.Access)
+	if err != nil {
+		return nil, err
+	}
+
+	previous, err := AccessToProto(change.PreviousAccess)
+	if err != nil {
+		return nil, err
+	}
+
+	return &userspb.AccessChange{
+		Access:         access,
+		PreviousAccess: previous,
+		Reason:         change.Reason,
+		ExpiresAt:      TimestampToProto(change.ExpiresAt),
+		ChangedAt:      TimestampToProto(change.ChangedAt),
+		ChangedBy:      change.ChangedBy,
+		Version:        change.Version,
+	}, nil
+}
+
+// DateToProto converts a stored date, kept as midnight UTC, to a
+// google.type.Date.
+func DateToProto(t time.Time) *date.Date {
+	return &date.Date{Year: int32(t.Year()), Month: int32(t.Month()), Day: int32(t.Day())}
+}
+
+// DateFromProto converts a google.type.Date to midnight UTC of that day. The
+// date must be complete and exist in the calendar.
+func DateFromProto(value *date.Date) (time.Time, error) {
+	t := time.Date(int(value.GetYear()), time.Month(value.GetMonth()), int(value.GetDay()), 0, 0, 0, 0, time.UTC)
+	if value.GetYear() == 0 || t.Year() != int(value.GetYear()) ||
+		t.Month() != time.Month(value.GetMonth()) || t.Day() != int(value.GetDay()) {
+		return time.Time{}, fmt.Errorf("%w: %04d-%02d-%02d", ErrInvalidDate, value.GetYear(), value.GetMonth(), value.GetDay())
+	}
+	return t, nil
+}
+
+// TimestampToProto converts t, leaving it unset when it was never recorded.
+func TimestampToProto(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+// displayEmail returns the address a user entered, falling back to the
+// canonical one for users stored before display forms were kept.
+func displayEmail(user *models.User) string {
+	if user.DisplayEmail != "" {
+		return user.DisplayEmail
+	}
+	return user.Email
+}
+
+func invert[E comparable](values map[E]string) map[string]E {
+	inverted := make(map[string]E, len(values))
+	for value, name := range values {
+		inverted[name] = value
+	}
+	return inverted
+}
+
+func names[E ~int32](values map[E]string) []string {
+	keys := make([]E, 0, len(values))
+	for value := range values {
+		keys = append(keys, value)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	result := make([]string, len(keys))
+	for i, value := range keys {
+		result[i] = values[value]
+	}
+	return result
+}
@@ -22,24 +22,130 @@ func InitDb() *gocqlx.Session {
 		log.Fatal("Failed to create keyspace:", err)
 	}
 
-	err = session.ExecStmt(`CREATE TABLE IF NOT EXISTS catalog.users (
+	err = session.ExecStmt(`CREATE TABLE IF NOT EXISTS catalog.users_by_id (
+		id uuid,
 		first_name text,
 		last_name text,
 		gender text,
 		dob date,
 		ph_number text,
 		email text,
+		display_email text,
 		access text,
-	    PRIMARY KEY (email)
+		access_expires_at timestamp,
+		version bigint,
+		created_at timestamp,
+		updated_at timestamp,
+		created_by text,
+		updated_by text,
+		deleted_at timestamp,
+		deleted_by text,
+	    PRIMARY KEY (id)
 	   )`)
 
 	if err != nil {
 		log.Fatal("Failed to create table", err.Error())
 	}
 
-	err = session.ExecStmt(`CREATE INDEX IF NOT EXISTS ON catalog.users (ph_number);`)
+	err = session.ExecStmt(`CREATE TABLE IF NOT EXISTS catalog.users_by_email (
+		email text,
+		id uuid,
+		claimed_at timestamp,
+		PRIMARY KEY (email)
+	   )`)
+	if err != nil {
+		log.Fatal("Failed to create users_by_email table", err.Error())
+	}
+
+	err = session.ExecStmt(`CREATE TABLE IF NOT EXISTS catalog.users_by_phone (
+		ph_number text,
+		id uuid,
+		claimed_at timestamp,
+		PRIMARY KEY (ph_number)
+	   )`)
+	if err != nil {
+		log.Fatal("Failed to create users_by_phone table", err.Error())
+	}
+
+	err = session.ExecStmt(`CREATE TABLE IF NOT EXISTS catalog.user_email_changes (
+		id uuid,
+		old_email text,
+		new_email text,
+		new_display_email text,
+		old_ph_number text,
+		new_ph_number text,
+		version bigint,
+		started_at timestamp,
+		updated_at timestamp,
+		updated_by text,
+		PRIMARY KEY (id)
+	   )`)
+	if err != nil {
+		log.Fatal("Failed to create user_email_changes table", err.Error())
+	}
+
+	err = session.ExecStmt(`CREATE TABLE IF NOT EXISTS catalog.user_access_changes (
+		user_id uuid,
+		version bigint,
+		access text,
+		previous_access text,
+		reason text,
+		expires_at timestamp,
+		changed_at timestamp,
+		changed_by text,
+		PRIMARY KEY (user_id, version)
+	   ) WITH CLUSTERING ORDER BY (version DESC)`)
+	if err != nil {
+		log.Fatal("Failed to create user_access_changes table", err.Error())
+	}
+
+	err = session.ExecStmt(`CREATE TABLE IF NOT EXISTS catalog.access_expiries (
+		shard int,
+		expires_at timestamp,
+		user_id uuid,
+		PRIMARY KEY (shard, expires_at, user_id)
+	   )`)
+	if err != nil {
+		log.Fatal("Failed to create access_expiries table", err.Error())
+	}
+
+	err = session.ExecStmt(`CREATE TABLE IF NOT EXISTS catalog.deleted_users (
+		shard int,
+		deleted_at timestamp,
+		user_id uuid,
+		PRIMARY KEY (shard, deleted_at, user_id)
+	   )`)
+	if err != nil {
+		log.Fatal("Failed to create deleted_users table", err.Error())
+	}
+
+	// Tables created by earlier versions lack the columns added since.
+	for _, column := range []struct{ table, name, cqlType string }{
+		{"users_by_id", "display_email", "text"},
+		{"users_by_id", "created_at", "timestamp"},
+		{"users_by_id", "updated_at", "timestamp"},
+		{"users_by_id", "created_by", "text"},
+		{"users_by_id", "updated_by", "text"},
+		{"users_by_id", "access_expires_at", "timestamp"},
+		{"users_by_id", "deleted_at", "timestamp"},
+		{"users_by_id", "deleted_by", "text"},
+		{"users_by_email", "claimed_at", "timestamp"},
+		{"users_by_phone", "claimed_at", "timestamp"},
+		{"user_email_changes", "new_display_email", "text"},
+		{"user_email_changes", "updated_at", "timestamp"},
+		{"user_email_changes", "updated_by", "text"},
+	} {
+		if err := addColumn(&session, "catalog", column.table, column.name, column.cqlType); err != nil {
+			log.Fatal("Failed to add ", column.name, " column: ", err.Error())
+		}
+	}
+
+	err = session.ExecStmt(`CREATE MATERIALIZED VIEW IF NOT EXISTS catalog.users_by_id_access_gender AS
+		SELECT * FROM catalog.users_by_id
+		WHERE access IS NOT NULL AND gender IS NOT NULL AND dob IS NOT NULL AND id IS NOT NULL
+		PRIMARY KEY ((access, gender), dob, id)`)
 	if err != nil {
-		log.Fatal("Error creating index:", err.Error())
+		log.Fatal("Error creating materialized view:", err.Error())
 	}
 
 	log.Println("Connected to sycalladb at: ", os.Getenv("SDB_URI"))
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/scylladb/gocqlx/v2"
+)
+
+// MigrateLegacyUsers copies users from the email-keyed catalog.users table into
+// catalog.users_by_id, assigning each one a new id and registering its email
+// and phone lookups. It is idempotent: users whose email is already registered
+// are skipped, so it can be rerun after an interruption. The legacy table is
+// left in place.
+func MigrateLegacyUsers(session *gocqlx.Session) error {
+	exists, err := tableExists(session, "catalog", "users")
+	if err != nil || !exists {
+		return err
+	}
+
+	hasVersion, err := columnExists(session, "catalog", "users", "version")
+	if err != nil {
+		return err
+	}
+
+	// Rows written by an interrupted email change of the previous schema still
+	// carry the old email in migrated_from; the original row is migrated instead.
+	hasMigratedFrom, err := columnExists(session, "catalog", "users", "migrated_from")
+	if err != nil {
+		return err
+	}
+
+	stmt := "SELECT email, first_name, last_name, ph_number, gender, dob, access"
+	if hasVersion {
+		stmt += ", version"
+	}
+	if hasMigratedFrom {
+		stmt += ", migrated_from"
+	}
+	stmt += " FROM catalog.users"
+
+	iter := session.Query(stmt, nil).Iter()
+
+	migrated, skipped := 0, 0
+	for {
+		row := map[string]interface{}{}
+		if !iter.MapScan(row) {
+			break
+		}
+
+		if migratedFrom, _ := row["migrated_from"].(string); migratedFrom != "" {
+			skipped++
+			continue
+		}
+
+		version, _ := row["version"].(int64)
+		if version == 0 {
+			version = 1
+		}
+
+		email, _ := row["email"].(string)
+		id := gocql.TimeUUID()
+
+		applied, err := session.Query(`INSERT INTO catalog.users_by_email (email, id) VALUES (?, ?) IF NOT EXISTS`, nil).
+			Bind(email, id).
+			ExecCASRelease()
+		if err != nil {
+			iter.Close()
+			return err
+		}
+
+		if !applied {
+			// A previous run registered the email. Reuse its id so that a
+			// run interrupted before the user row was written is completed.
+			if err := session.Query(`SELECT id FROM catalog.users_by_email WHERE email = ?`, nil).
+				Bind(email).
+				GetRelease(&id); err != nil {
+				iter.Close()
+				return err
+			}
+
+			var count int
+			if err := session.Query(`SELECT COUNT(*) FROM catalog.users_by_id WHERE id = ?`, nil).
+				Bind(id).
+				GetRelease(&count); err != nil {
+				iter.Close()
+				return err
+			}
+
+			if count > 0 {
+				skipped++
+				continue
+			}
+		}
+
+		dob, _ := row["dob"].(time.Time)
+		err = session.Query(`INSERT INTO catalog.users_by_id
+			(id, email, first_name, last_name, ph_number, gender, dob, access, version)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, nil).
+			Bind(id, email, row["first_name"], row["last_name"], row["ph_number"], row["gender"], dob, row["access"], version).
+			ExecRelease()
+		if err != nil {
+			iter.Close()
+			return err
+		}
+
+		if phone, _ := row["ph_number"].(string); phone != "" {
+			applied, err := session.Query(`INSERT INTO catalog.users_by_phone (ph_number, id) VALUES (?, ?) IF NOT EXISTS`, nil).
+				Bind(phone, id).
+				ExecCASRelease()
+			if err != nil {
+				iter.Close()
+				return err
+			}
+
+			if !applied {
+				log.Printf("Warning: phone number of %s is already registered to another user, it cannot be used for lookups until changed", email)
+			}
+		}
+
+		migrated++
+	}
+
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	log.Printf("Migrated %d legacy users, skipped %d", migrated, skipped)
+	return nil
+}
+
+func tableExists(session *gocqlx.Session, keyspace, table string) (bool, error) {
+	var count int
+	err := session.Query(`SELECT COUNT(*) FROM system_schema.tables
+		WHERE keyspace_name = ? AND table_name = ?`, nil).
+		Bind(keyspace, table).
+		GetRelease(&count)
+	return count > 0, err
+}
+
+// addColumn adds column to table unless it is already there.
+func addColumn(session *gocqlx.Session, keyspace, table, column, cqlType string) error {
+	exists, err := columnExists(session, keyspace, table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	return session.ExecStmt(fmt.Sprintf("ALTER TABLE %s.%s ADD %s %s", keyspace, table, column, cqlType))
+}
+
+func columnExists(session *gocqlx.Session, keyspace, table, column string) (bool, error) {
+	var count int
+	err := session.Query(`SELECT COUNT(*) FROM system_schema.columns
+		WHERE keyspace_name = ? AND table_name = ? AND column_name = ?`, nil).
+		Bind(keyspace, table, column).
+		GetRelease(&count)
+	return count > 0, err
+}
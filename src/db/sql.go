@@ -0,0 +1,106 @@
+package db
+
+import (
+	"database/sql"
+	"log"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+// InitSQLDb opens a SQL database for the "sqlite" or "pgx" (PostgreSQL) driver
+// and creates the users and access history tables. The unique constraints on email and ph_number
+// take the place of the lookup tables used with ScyllaDB.
+func InitSQLDb(driver, dsn string) *sql.DB {
+	conn, err := sql.Open(driver, dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if driver == "sqlite" {
+		// SQLite allows a single writer; sharing one connection avoids
+		// SQLITE_BUSY errors between concurrent requests.
+		conn.SetMaxOpenConns(1)
+	}
+
+	if err := conn.Ping(); err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+
+	_, err = conn.Exec(`CREATE TABLE IF NOT EXISTS users (
+		id TEXT PRIMARY KEY,
+		email TEXT NOT NULL UNIQUE,
+		display_email TEXT NOT NULL DEFAULT '',
+		ph_number TEXT NOT NULL UNIQUE,
+		first_name TEXT NOT NULL,
+		last_name TEXT NOT NULL,
+		gender TEXT NOT NULL,
+		dob DATE NOT NULL,
+		access TEXT NOT NULL,
+		access_expires_at TIMESTAMP,
+		version BIGINT NOT NULL,
+		created_at TIMESTAMP,
+		updated_at TIMESTAMP,
+		created_by TEXT NOT NULL DEFAULT '',
+		updated_by TEXT NOT NULL DEFAULT '',
+		deleted_at TIMESTAMP,
+		deleted_by TEXT NOT NULL DEFAULT ''
+	)`)
+	if err != nil {
+		log.Fatal("Failed to create table", err.Error())
+	}
+
+	// Tables created by earlier versions lack the columns added since. Users
+	// stored before timestamps were recorded keep them NULL.
+	for _, column := range []struct{ name, definition string }{
+		{"display_email", "TEXT NOT NULL DEFAULT ''"},
+		{"created_at", "TIMESTAMP"},
+		{"updated_at", "TIMESTAMP"},
+		{"created_by", "TEXT NOT NULL DEFAULT ''"},
+		{"updated_by", "TEXT NOT NULL DEFAULT ''"},
+		{"access_expires_at", "TIMESTAMP"},
+		{"deleted_at", "TIMESTAMP"},
+		{"deleted_by", "TEXT NOT NULL DEFAULT ''"},
+	} {
+		if _, err := conn.Exec(`SELECT ` + column.name + ` FROM users LIMIT 1`); err == nil {
+			continue
+		}
+
+		if _, err := conn.Exec(`ALTER TABLE users ADD COLUMN ` + column.name + ` ` + column.definition); err != nil {
+			log.Fatal("Failed to add ", column.name, " column: ", err.Error())
+		}
+	}
+
+	_, err = conn.Exec(`CREATE INDEX IF NOT EXISTS users_access_gender_dob ON users (access, gender, dob)`)
+	if err != nil {
+		log.Fatal("Error creating index:", err.Error())
+	}
+
+	_, err = conn.Exec(`CREATE INDEX IF NOT EXISTS users_access_expires_at ON users (access_expires_at)`)
+	if err != nil {
+		log.Fatal("Error creating index:", err.Error())
+	}
+
+	_, err = conn.Exec(`CREATE INDEX IF NOT EXISTS users_deleted_at ON users (deleted_at)`)
+	if err != nil {
+		log.Fatal("Error creating index:", err.Error())
+	}
+
+	_, err = conn.Exec(`CREATE TABLE IF NOT EXISTS user_access_changes (
+		user_id TEXT NOT NULL,
+		version BIGINT NOT NULL,
+		access TEXT NOT NULL,
+		previous_access TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		expires_at TIMESTAMP,
+		changed_at TIMESTAMP NOT NULL,
+		changed_by TEXT NOT NULL,
+		PRIMARY KEY (user_id, version)
+	)`)
+	if err != nil {
+		log.Fatal("Failed to create user_access_changes table", err.Error())
+	}
+
+	log.Println("Connected to", driver, "database")
+	return conn
+}
@@ -0,0 +1,66 @@
+package email
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrInvalid = errors.New("not a valid email address")
+
+// providerDomains maps domains whose provider ignores dots and "+tag"
+// suffixes in the local part to the domain their addresses are stored under.
+var providerDomains = map[string]string{
+	"gmail.com":      "gmail.com",
+	"googlemail.com": "gmail.com",
+}
+
+// Canonicalizer turns email addresses the way users type them
+// (" Alice@Example.COM") into the canonical form that is stored and looked
+// up ("alice@example.com"), so that addresses differing only in case name the
+// same user.
+//
+// The local part is lowercased along with the domain. Mail servers may treat
+// "Alice@example.com" and "alice@example.com" as different mailboxes, but
+// this service deliberately merges them into one account; the address as
+// typed is kept as the display form.
+type Canonicalizer struct {
+	providerRules bool
+}
+
+// NewCanonicalizer returns a Canonicalizer. With providerRules set, addresses
+// of providers that ignore dots and "+tag" suffixes, such as Gmail, are also
+// reduced to their base mailbox.
+func NewCanonicalizer(providerRules bool) *Canonicalizer {
+	return &Canonicalizer{providerRules: providerRules}
+}
+
+func (c *Canonicalizer) Canonicalize(raw string) (string, error) {
+	address := strings.ToLower(strings.TrimSpace(raw))
+
+	at := strings.LastIndex(address, "@")
+	if at <= 0 || at == len(address)-1 {
+		return "", ErrInvalid
+	}
+
+	local, domain := address[:at], address[at+1:]
+
+	if canonicalDomain, ok := providerDomains[domain]; ok && c.providerRules {
+		if plus := strings.Index(local, "+"); plus >= 0 {
+			local = local[:plus]
+		}
+		local = strings.ReplaceAll(local, ".", "")
+		domain = canonicalDomain
+
+		if local == "" {
+			return "", ErrInvalid
+		}
+	}
+
+	return local + "@" + domain, nil
+}
+
+// Display returns the address as it should be shown back to the user: the
+// way it was typed, without surrounding whitespace.
+func Display(raw string) string {
+	return strings.TrimSpace(raw)
+}
@@ -0,0 +1,159 @@
+package events
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	userspb "2k4sm/grpc-crud/proto/users"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	ErrCursorExpired = errors.New("cursor is older than the retained event history")
+	// ErrUnknownCursor is returned for a cursor this broker did not issue,
+	// such as one from another server process or from before a restart.
+	ErrUnknownCursor = errors.New("cursor was not issued by this server process")
+)
+
+type Subscription struct {
+	Events <-chan *userspb.UserEvent
+	cancel func()
+}
+
+func (s *Subscription) Cancel() {
+	s.cancel()
+}
+
+// Broker fans events out to subscribers and keeps the latest ones for
+// resuming. Cursors are "<broker id>.<sequence>", so a cursor can be told
+// apart from one issued by another broker.
+type Broker struct {
+	mu          sync.Mutex
+	id          string
+	seq         uint64
+	history     []*userspb.UserEvent
+	historySize int
+	subscribers map[chan *userspb.UserEvent]struct{}
+}
+
+func NewBroker(historySize int) *Broker {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Sprintf("generating broker id: %v", err))
+	}
+
+	return &Broker{
+		id:          hex.EncodeToString(id),
+		historySize: historySize,
+		subscribers: make(map[chan *userspb.UserEvent]struct{}),
+	}
+}
+
+func (b *Broker) Publish(eventType userspb.UserEventType, user *userspb.UserResponse, previousEmail string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	event := &userspb.UserEvent{
+		Cursor:        b.id + "." + strconv.FormatUint(b.seq, 10),
+		Type:          eventType,
+		User:          user,
+		PreviousEmail: previousEmail,
+		OccurredAt:    timestamppb.Now(),
+	}
+
+	b.history = append(b.history, event)
+	if len(b.history) > b.historySize {
+		b.history = b.history[len(b.history)-b.historySize:]
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// A subscriber that cannot keep up is dropped rather than blocking
+			// writers; it can resume from the last cursor it received.
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns the retained events after cursor followed by live events.
+// An empty cursor starts from the next published event. A cursor from another
+// broker fails with ErrUnknownCursor and one whose successors are no longer
+// retained with ErrCursorExpired, since replaying from either would silently
+// skip events.
+func (b *Broker) Subscribe(cursor string, bufferSize int) ([]*userspb.UserEvent, *Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var backlog []*userspb.UserEvent
+	if cursor != "" {
+		id, after, err := parseCursor(cursor)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if id != b.id || after > b.seq {
+			return nil, nil, ErrUnknownCursor
+		}
+
+		if after < b.seq {
+			if len(b.history) == 0 || after+1 < b.sequence(b.history[0]) {
+				return nil, nil, ErrCursorExpired
+			}
+
+			for _, event := range b.history {
+				if b.sequence(event) > after {
+					backlog = append(backlog, event)
+				}
+			}
+		}
+	}
+
+	ch := make(chan *userspb.UserEvent, bufferSize)
+	b.subscribers[ch] = struct{}{}
+
+	sub := &Subscription{
+		Events: ch,
+		cancel: func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			if _, ok := b.subscribers[ch]; ok {
+				delete(b.subscribers, ch)
+				close(ch)
+			}
+		},
+	}
+
+	return backlog, sub, nil
+}
+
+// sequence returns the sequence number of an event this broker published.
+func (b *Broker) sequence(event *userspb.UserEvent) uint64 {
+	_, seq, _ := parseCursor(event.Cursor)
+	return seq
+}
+
+// parseCursor splits a cursor into broker id and sequence. Cursors issued
+// before brokers had ids are a bare sequence and get an empty id.
+func parseCursor(cursor string) (string, uint64, error) {
+	id, seq, ok := strings.Cut(cursor, ".")
+	if !ok {
+		id, seq = "", cursor
+	}
+
+	after, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return "", 0, err
+	}
+	return id, after, nil
+}
@@ -3,46 +3,146 @@ package models
 import (
 	"time"
 
-	userspb "2k4sm/grpc-crud/proto/users"
-
+	"github.com/gocql/gocql"
 	"github.com/scylladb/gocqlx/table"
 )
 
-func AccessStrToAccess(access string) userspb.Access {
-	res := userspb.Access_UNBLOCKED
+type User struct {
+	ID gocql.UUID `db:"id"`
+	// Email is the canonical address used for lookups; DisplayEmail keeps the
+	// address as it was entered and is empty for users stored before it was.
+	Email        string    `db:"email"`
+	DisplayEmail string    `db:"display_email"`
+	PhNumber     string    `db:"ph_number"`
+	FirstName    string    `db:"first_name"`
+	LastName     string    `db:"last_name"`
+	Gender       string    `db:"gender"`
+	Dob          time.Time `db:"dob"`
+	Access       string    `db:"access"`
+	// AccessExpiresAt is when a time-limited block ends and zero for blocks
+	// that do not end on their own.
+	AccessExpiresAt time.Time `db:"access_expires_at"`
+	Version         int64     `db:"version"`
+	// Zero for users stored before writes were recorded.
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+	CreatedBy string    `db:"created_by"`
+	UpdatedBy string    `db:"updated_by"`
+	// DeletedAt is set while the user is deleted but can still be restored.
+	// A deleted user keeps its email and phone number until it is purged.
+	DeletedAt time.Time `db:"deleted_at"`
+	DeletedBy string    `db:"deleted_by"`
+}
+
+// Modification records when a write happened and who made it. Every write of
+// a user stores it as updated_at and updated_by.
+type Modification struct {
+	At time.Time
+	By string
+}
 
-	switch access {
-	case "BLOCKED":
-		res = userspb.Access_BLOCKED
-	case "UNBLOCKED":
-		res = userspb.Access_UNBLOCKED
-	}
-	return res
+type EmailChange struct {
+	ID              gocql.UUID `db:"id"`
+	OldEmail        string     `db:"old_email"`
+	NewEmail        string     `db:"new_email"`
+	NewDisplayEmail string     `db:"new_display_email"`
+	OldPhNumber     string     `db:"old_ph_number"`
+	NewPhNumber     string     `db:"new_ph_number"`
+	Version         int64      `db:"version"`
+	StartedAt       time.Time  `db:"started_at"`
+	UpdatedAt       time.Time  `db:"updated_at"`
+	UpdatedBy       string     `db:"updated_by"`
 }
 
-func GenderStrToGender(gender string) userspb.Gender {
-	res := userspb.Gender_MALE
-	switch gender {
-	case "MALE":
-		res = userspb.Gender_MALE
-	case "FEMALE":
-		res = userspb.Gender_FEMALE
-	}
-	return res
+// AccessChange is an entry of a user's access history. Entries are keyed by
+// the user version the change produced and never rewritten.
+type AccessChange struct {
+	UserID         gocql.UUID `db:"user_id"`
+	Version        int64      `db:"version"`
+	Access         string     `db:"access"`
+	PreviousAccess string     `db:"previous_access"`
+	Reason         string     `db:"reason"`
+	ExpiresAt      time.Time  `db:"expires_at"`
+	ChangedAt      time.Time  `db:"changed_at"`
+	ChangedBy      string     `db:"changed_by"`
 }
 
-type User struct {
-	Email     string    `db:"email"`
-	PhNumber  string    `db:"ph_number"`
-	FirstName string    `db:"first_name"`
-	LastName  string    `db:"last_name"`
-	Gender    string    `db:"gender"`
-	Dob       time.Time `db:"dob"`
-	Access    string    `db:"access"`
+// AccessExpiry marks when the block of a user ends. ScyllaDB keeps these in a
+// due-time table spread over a fixed number of shards, so expired blocks are
+// found without scanning users.
+type AccessExpiry struct {
+	Shard     int        `db:"shard"`
+	ExpiresAt time.Time  `db:"expires_at"`
+	UserID    gocql.UUID `db:"user_id"`
+}
+
+// UserDeletion marks when a user was deleted. Like AccessExpiry, ScyllaDB
+// keeps these in a sharded due-time table so that users due for purging are
+// found without scanning.
+type UserDeletion struct {
+	Shard     int        `db:"shard"`
+	DeletedAt time.Time  `db:"deleted_at"`
+	UserID    gocql.UUID `db:"user_id"`
+}
+
+// UserFilter narrows a listing. Deleted selects deleted users instead of the
+// live ones.
+type UserFilter struct {
+	Access  []string
+	Gender  []string
+	DobFrom *time.Time
+	DobTo   *time.Time
+	Deleted bool
 }
 
 var UserMetadata = table.Metadata{
-	Name:    "catalog.users",
-	Columns: []string{"email", "ph_number", "first_name", "last_name", "gender", "dob", "access"},
+	Name:    "catalog.users_by_id",
+	Columns: []string{"id", "email", "display_email", "ph_number", "first_name", "last_name", "gender", "dob", "access", "access_expires_at", "version", "created_at", "updated_at", "created_by", "updated_by", "deleted_at", "deleted_by"},
+	PartKey: []string{"id"},
+}
+
+var EmailLookupMetadata = table.Metadata{
+	Name:    "catalog.users_by_email",
+	Columns: []string{"email", "id", "claimed_at"},
 	PartKey: []string{"email"},
 }
+
+var PhoneLookupMetadata = table.Metadata{
+	Name:    "catalog.users_by_phone",
+	Columns: []string{"ph_number", "id", "claimed_at"},
+	PartKey: []string{"ph_number"},
+}
+
+var EmailChangeMetadata = table.Metadata{
+	Name:    "catalog.user_email_changes",
+	Columns: []string{"id", "old_email", "new_email", "new_display_email", "old_ph_number", "new_ph_number", "version", "started_at", "updated_at", "updated_by"},
+	PartKey: []string{"id"},
+}
+
+var AccessChangeMetadata = table.Metadata{
+	Name:    "catalog.user_access_changes",
+	Columns: []string{"user_id", "version", "access", "previous_access", "reason", "expires_at", "changed_at", "changed_by"},
+	PartKey: []string{"user_id"},
+	SortKey: []string{"version"},
+}
+
+var AccessExpiryMetadata = table.Metadata{
+	Name:    "catalog.access_expiries",
+	Columns: []string{"shard", "expires_at", "user_id"},
+	PartKey: []string{"shard"},
+	SortKey: []string{"expires_at", "user_id"},
+}
+
+var UserDeletionMetadata = table.Metadata{
+	Name:    "catalog.deleted_users",
+	Columns: []string{"shard", "deleted_at", "user_id"},
+	PartKey: []string{"shard"},
+	SortKey: []string{"deleted_at", "user_id"},
+}
+
+var UsersByAccessGenderMetadata = table.Metadata{
+	Name:    "catalog.users_by_id_access_gender",
+	Columns: []string{"access", "gender", "dob", "id", "email", "display_email", "ph_number", "first_name", "last_name", "access_expires_at", "version", "created_at", "updated_at", "created_by", "updated_by", "deleted_at", "deleted_by"},
+	PartKey: []string{"access", "gender"},
+	SortKey: []string{"dob", "id"},
+}
@@ -0,0 +1,42 @@
+package phone
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nyaruka/phonenumbers"
+)
+
+var ErrInvalid = errors.New("not a valid phone number")
+
+// Normalizer turns phone numbers the way users type them ("9876543210",
+// "+91 98765 43210", "098765-43210") into E.164 ("+919876543210"), which is
+// the only form that is stored and looked up.
+type Normalizer struct {
+	defaultRegion string
+}
+
+// NewNormalizer returns a Normalizer that reads numbers without a country
+// code as numbers of defaultRegion, an ISO 3166-1 region code such as "IN".
+func NewNormalizer(defaultRegion string) (*Normalizer, error) {
+	region := strings.ToUpper(defaultRegion)
+	if phonenumbers.GetCountryCodeForRegion(region) == 0 {
+		return nil, fmt.Errorf("unknown phone region %q", defaultRegion)
+	}
+
+	return &Normalizer{defaultRegion: region}, nil
+}
+
+func (n *Normalizer) Normalize(raw string) (string, error) {
+	number, err := phonenumbers.Parse(raw, n.defaultRegion)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+
+	if !phonenumbers.IsValidNumber(number) {
+		return "", ErrInvalid
+	}
+
+	return phonenumbers.Format(number, phonenumbers.E164), nil
+}
@@ -0,0 +1,40 @@
+package repositories
+
+import (
+	"context"
+
+	"2k4sm/grpc-crud/src/convert"
+	"2k4sm/grpc-crud/src/models"
+)
+
+// EachUser calls fn for every stored user, deleted ones included, listing
+// pageSize users at a time. ListUsers only returns deleted users for a filter
+// asking for them, so they are visited in a second pass after the live ones.
+func EachUser(ctx context.Context, repo UserRepository, pageSize int, fn func(user *models.User)) error {
+	deleted := &models.UserFilter{
+		Access:  convert.Accesses(),
+		Gender:  convert.Genders(),
+		Deleted: true,
+	}
+
+	for _, filter := range []*models.UserFilter{nil, deleted} {
+		var pageState []byte
+		for {
+			users, nextPageState, err := repo.ListUsers(ctx, filter, pageSize, pageState)
+			if err != nil {
+				return err
+			}
+
+			for i := range users {
+				fn(&users[i])
+			}
+
+			if len(nextPageState) == 0 {
+				break
+			}
+			pageState = nextPageState
+		}
+	}
+
+	return nil
+}
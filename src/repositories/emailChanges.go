@@ -0,0 +1,217 @@
+package repositories
+
+import (
+	"2k4sm/grpc-crud/src/models"
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/scylladb/gocqlx/qb"
+)
+
+// An email change has to move the users_by_email registration and update the
+// user row, which Scylla cannot do in one statement. The change is journaled in
+// catalog.user_email_changes before anything else is written, and the new
+// email is claimed before the row is touched. A journal entry left behind by a
+// crash is rolled forward if the claim succeeded and rolled back otherwise, so
+// a user can always be found under exactly one email.
+
+func (r *UserRepositoryImpl) ChangeEmail(ctx context.Context, user *models.User, newEmail, newDisplayEmail, newPhone string, modified models.Modification) (*models.User, error) {
+	change := &models.EmailChange{
+		ID:              user.ID,
+		OldEmail:        user.Email,
+		NewEmail:        newEmail,
+		NewDisplayEmail: newDisplayEmail,
+		OldPhNumber:     user.PhNumber,
+		NewPhNumber:     user.PhNumber,
+		Version:         user.Version,
+		StartedAt:       time.Now(),
+		UpdatedAt:       modified.At,
+		UpdatedBy:       modified.By,
+	}
+	if newPhone != "" {
+		change.NewPhNumber = newPhone
+	}
+
+	stmt, names := qb.Insert(r.emailChanges.Name()).
+		Columns(models.EmailChangeMetadata.Columns...).
+		Unique().
+		ToCql()
+
+	applied, err := r.session.Query(stmt, names).BindStruct(change).ExecCASRelease()
+	if err != nil {
+		return nil, scyllaError(err)
+	}
+
+	if !applied {
+		// Another change of this user is in flight or was interrupted. Settle
+		// it first; the caller has to re-read the user before retrying.
+		if err := r.resumePendingEmailChange(ctx, user.ID); err != nil {
+			return nil, err
+		}
+		return nil, ErrVersionConflict
+	}
+
+	if change.NewPhNumber != change.OldPhNumber {
+		claimed, err := r.claimPhone(ctx, change.NewPhNumber, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !claimed {
+			if err := r.deleteEmailChange(user.ID); err != nil {
+				return nil, err
+			}
+			return nil, ErrPhoneTaken
+		}
+	}
+
+	if _, err := r.claimEmail(ctx, newEmail, user.ID); err != nil {
+		return nil, err
+	}
+
+	return r.completeEmailChange(ctx, change)
+}
+
+func (r *UserRepositoryImpl) ResumeEmailChanges(ctx context.Context) error {
+	stmt, names := qb.Select(r.emailChanges.Name()).
+		Columns(models.EmailChangeMetadata.Columns...).
+		ToCql()
+
+	var changes []models.EmailChange
+	if err := r.session.Query(stmt, names).SelectRelease(&changes); err != nil {
+		return scyllaError(err)
+	}
+
+	for i := range changes {
+		if _, err := r.completeEmailChange(ctx, &changes[i]); err != nil && !errors.Is(err, ErrEmailTaken) && !errors.Is(err, ErrVersionConflict) {
+			return err
+		}
+		log.Printf("Resolved pending email change from %s to %s", changes[i].OldEmail, changes[i].NewEmail)
+	}
+
+	return nil
+}
+
+func (r *UserRepositoryImpl) resumePendingEmailChange(ctx context.Context, id gocql.UUID) error {
+	stmt, names := qb.Select(r.emailChanges.Name()).
+		Columns(models.EmailChangeMetadata.Columns...).
+		Where(qb.Eq("id")).
+		ToCql()
+
+	var change models.EmailChange
+	err := r.session.Query(stmt, names).BindMap(qb.M{"id": id}).GetRelease(&change)
+	if errors.Is(err, gocql.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return scyllaError(err)
+	}
+
+	_, err = r.completeEmailChange(ctx, &change)
+	if errors.Is(err, ErrEmailTaken) || errors.Is(err, ErrVersionConflict) {
+		return nil
+	}
+	return err
+}
+
+// completeEmailChange drives a journaled change to a final state. It is
+// idempotent, so it is safe to run again after a crash at any step.
+func (r *UserRepositoryImpl) completeEmailChange(ctx context.Context, change *models.EmailChange) (*models.User, error) {
+	ownerID, err := r.lookupID(r.emailLookup, "email", change.NewEmail)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	if err != nil || ownerID != change.ID {
+		// The new email was never claimed for this user, so the user row is
+		// untouched and only the journal entry and phone claim need undoing.
+		if err := r.rollbackEmailChange(change, false); err != nil {
+			return nil, err
+		}
+		return nil, ErrEmailTaken
+	}
+
+	user, err := r.GetUserByID(ctx, change.ID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	if err != nil || user.Email != change.NewEmail {
+		stmt, names := qb.Update(r.table.Name()).
+			Set("email", "display_email", "ph_number", "updated_at", "updated_by", "version").
+			Where(qb.Eq("id")).
+			If(qb.EqNamed("version", "expected_version")).
+			ToCql()
+
+		applied, err := r.session.Query(stmt, names).BindMap(qb.M{
+			"email":            change.NewEmail,
+			"display_email":    change.NewDisplayEmail,
+			"ph_number":        change.NewPhNumber,
+			"updated_at":       change.UpdatedAt,
+			"updated_by":       change.UpdatedBy,
+			"version":          change.Version + 1,
+			"id":               change.ID,
+			"expected_version": change.Version,
+		}).ExecCASRelease()
+		if err != nil {
+			return nil, scyllaError(err)
+		}
+
+		if !applied {
+			// The user was written or deleted after the change started. Keep
+			// that write and release the claimed values instead.
+			if err := r.rollbackEmailChange(change, true); err != nil {
+				return nil, err
+			}
+			return nil, ErrVersionConflict
+		}
+
+		if user, err = r.GetUserByID(ctx, change.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	if change.NewPhNumber != change.OldPhNumber {
+		if err := r.clearLookup(r.phoneLookup, "ph_number", change.OldPhNumber, change.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := r.clearLookup(r.emailLookup, "email", change.OldEmail, change.ID); err != nil {
+		return nil, err
+	}
+
+	if err := r.deleteEmailChange(change.ID); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (r *UserRepositoryImpl) rollbackEmailChange(change *models.EmailChange, emailClaimed bool) error {
+	if emailClaimed {
+		if err := r.clearLookup(r.emailLookup, "email", change.NewEmail, change.ID); err != nil {
+			return err
+		}
+	}
+
+	if change.NewPhNumber != change.OldPhNumber {
+		if err := r.clearLookup(r.phoneLookup, "ph_number", change.NewPhNumber, change.ID); err != nil {
+			return err
+		}
+	}
+
+	return r.deleteEmailChange(change.ID)
+}
+
+func (r *UserRepositoryImpl) deleteEmailChange(id gocql.UUID) error {
+	stmt, names := qb.Delete(r.emailChanges.Name()).
+		Where(qb.Eq("id")).
+		Existing().
+		ToCql()
+
+	_, err := r.session.Query(stmt, names).BindMap(qb.M{"id": id}).ExecCASRelease()
+	return scyllaError(err)
+}
@@ -0,0 +1,153 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/gocql/gocql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Every repository reports failures as one of these kinds so callers can tell
+// a missing user from a storage outage without knowing which backend is in
+// use. Driver errors are wrapped, not replaced, and stay reachable through
+// errors.Is and errors.As.
+var (
+	ErrNotFound    = errors.New("user not found")
+	ErrConflict    = errors.New("conflicting write")
+	ErrUnavailable = errors.New("storage unavailable")
+	ErrTimeout     = errors.New("storage timed out")
+)
+
+var (
+	ErrEmailTaken      = fmt.Errorf("%w: email already belongs to another user", ErrConflict)
+	ErrPhoneTaken      = fmt.Errorf("%w: phone number already belongs to another user", ErrConflict)
+	ErrVersionConflict = fmt.Errorf("%w: user was modified concurrently", ErrConflict)
+)
+
+// ErrInvalidPageState reports a page state the backend did not hand out.
+var ErrInvalidPageState = errors.New("invalid page state")
+
+func wrapError(kind, err error) error {
+	return fmt.Errorf("%w: %w", kind, err)
+}
+
+// isRepositoryError reports whether err already carries one of the kinds
+// above, in which case it is passed through unchanged.
+func isRepositoryError(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, ErrConflict) ||
+		errors.Is(err, ErrUnavailable) || errors.Is(err, ErrTimeout)
+}
+
+// contextError classifies cancellations and deadlines, which every backend
+// can return, and reports false for anything else.
+func contextError(err error) (error, bool) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return wrapError(ErrTimeout, err), true
+	case errors.Is(err, context.Canceled):
+		return wrapError(ErrUnavailable, err), true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return wrapError(ErrTimeout, err), true
+		}
+		return wrapError(ErrUnavailable, err), true
+	}
+
+	return nil, false
+}
+
+// scyllaError translates an error returned by gocql.
+func scyllaError(err error) error {
+	if err == nil || isRepositoryError(err) {
+		return err
+	}
+
+	if errors.Is(err, gocql.ErrNotFound) {
+		return wrapError(ErrNotFound, err)
+	}
+
+	if translated, ok := contextError(err); ok {
+		return translated
+	}
+
+	switch {
+	case errors.Is(err, gocql.ErrTimeoutNoResponse), errors.Is(err, gocql.ErrTooManyTimeouts):
+		return wrapError(ErrTimeout, err)
+	case errors.Is(err, gocql.ErrNoConnections), errors.Is(err, gocql.ErrConnectionClosed),
+		errors.Is(err, gocql.ErrSessionClosed), errors.Is(err, gocql.ErrNoStreams),
+		errors.Is(err, gocql.ErrUnavailable):
+		return wrapError(ErrUnavailable, err)
+	}
+
+	var requestErr gocql.RequestError
+	if errors.As(err, &requestErr) {
+		switch requestErr.Code() {
+		case gocql.ErrCodeReadTimeout, gocql.ErrCodeWriteTimeout, gocql.ErrCodeCASWriteUnknown:
+			return wrapError(ErrTimeout, err)
+		case gocql.ErrCodeUnavailable, gocql.ErrCodeOverloaded, gocql.ErrCodeBootstrapping,
+			gocql.ErrCodeReadFailure, gocql.ErrCodeWriteFailure:
+			return wrapError(ErrUnavailable, err)
+		}
+	}
+
+	return err
+}
+
+// sqlError translates an error returned by database/sql, the SQLite driver
+// or pgx.
+func sqlError(err error) error {
+	if err == nil || isRepositoryError(err) {
+		return err
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return wrapError(ErrNotFound, err)
+	}
+
+	if translated, ok := contextError(err); ok {
+		return translated
+	}
+
+	if errors.Is(err, sql.ErrConnDone) || errors.Is(err, driver.ErrBadConn) {
+		return wrapError(ErrUnavailable, err)
+	}
+
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		switch {
+		case sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE, sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+			return wrapError(ErrConflict, err)
+		case sqliteErr.Code()&0xff == sqlite3.SQLITE_BUSY, sqliteErr.Code()&0xff == sqlite3.SQLITE_LOCKED:
+			return wrapError(ErrUnavailable, err)
+		}
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case pgErr.Code == "23505":
+			return wrapError(ErrConflict, err)
+		case pgErr.Code == "57014":
+			return wrapError(ErrTimeout, err)
+		case pgErr.Code[:2] == "08", pgErr.Code[:2] == "53", pgErr.Code == "57P01", pgErr.Code == "57P03":
+			return wrapError(ErrUnavailable, err)
+		}
+	}
+
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return wrapError(ErrUnavailable, err)
+	}
+
+	return err
+}
@@ -0,0 +1,372 @@
+package repositories
+
+import (
+	"2k4sm/grpc-crud/src/models"
+	"bytes"
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// InMemoryUserRepository keeps users in process memory for tests and local
+// development. It mirrors UserRepositoryImpl: creates behave like LWTs and
+// report applied=false for a taken email, conditional writes fail on a version
+// mismatch, and lookups of missing users return ErrNotFound.
+type InMemoryUserRepository struct {
+	mu      sync.RWMutex
+	users   map[gocql.UUID]models.User
+	byEmail map[string]gocql.UUID
+	byPhone map[string]gocql.UUID
+	// accessLog holds the access history of every user, oldest change first.
+	accessLog map[gocql.UUID][]models.AccessChange
+}
+
+func NewInMemoryUserRepository() UserRepository {
+	return &InMemoryUserRepository{
+		users:     make(map[gocql.UUID]models.User),
+		byEmail:   make(map[string]gocql.UUID),
+		byPhone:   make(map[string]gocql.UUID),
+		accessLog: make(map[gocql.UUID][]models.AccessChange),
+	}
+}
+
+func (r *InMemoryUserRepository) CreateUser(ctx context.Context, user *models.User) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.byEmail[user.Email]; ok {
+		return false, nil
+	}
+
+	if _, ok := r.byPhone[user.PhNumber]; ok {
+		return false, ErrPhoneTaken
+	}
+
+	r.users[user.ID] = *user
+	r.byEmail[user.Email] = user.ID
+	r.byPhone[user.PhNumber] = user.ID
+	return true, nil
+}
+
+func (r *InMemoryUserRepository) GetUserByID(ctx context.Context, id gocql.UUID) (*models.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.get(id)
+}
+
+func (r *InMemoryUserRepository) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	id, ok := r.byEmail[email]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return r.get(id)
+}
+
+func (r *InMemoryUserRepository) GetUserByPhone(ctx context.Context, phone string) (*models.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	id, ok := r.byPhone[phone]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return r.get(id)
+}
+
+func (r *InMemoryUserRepository) GetUserByEmailAndPhone(ctx context.Context, email, phone string) (*models.User, error) {
+	user, err := r.GetUserByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.PhNumber != phone {
+		return nil, ErrNotFound
+	}
+
+	return user, nil
+}
+
+func (r *InMemoryUserRepository) UpdateUserAccess(ctx context.Context, change *models.AccessChange, expectedVersion int64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[change.UserID]
+	if !ok || user.Version != expectedVersion {
+		return false, nil
+	}
+
+	user.Access = change.Access
+	user.AccessExpiresAt = change.ExpiresAt
+	user.UpdatedAt = change.ChangedAt
+	user.UpdatedBy = change.ChangedBy
+	user.Version = expectedVersion + 1
+	r.users[change.UserID] = user
+
+	recorded := *change
+	recorded.Version = user.Version
+	r.accessLog[change.UserID] = append(r.accessLog[change.UserID], recorded)
+	return true, nil
+}
+
+func (r *InMemoryUserRepository) UpdateUser(ctx context.Context, user *models.User, fields []string, modified models.Modification, expectedVersion int64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.users[user.ID]
+	if !ok || existing.Version != expectedVersion {
+		return false, nil
+	}
+
+	previousPhone := existing.PhNumber
+	if slices.Contains(fields, "ph_number") && user.PhNumber != previousPhone {
+		if owner, ok := r.byPhone[user.PhNumber]; ok && owner != user.ID {
+			return false, ErrPhoneTaken
+		}
+	}
+
+	for _, field := range fields {
+		switch field {
+		case "first_name":
+			existing.FirstName = user.FirstName
+		case "last_name":
+			existing.LastName = user.LastName
+		case "ph_number":
+			existing.PhNumber = user.PhNumber
+		case "gender":
+			existing.Gender = user.Gender
+		case "dob":
+			existing.Dob = user.Dob
+		}
+	}
+
+	existing.UpdatedAt = modified.At
+	existing.UpdatedBy = modified.By
+	existing.Version = expectedVersion + 1
+	r.users[user.ID] = existing
+
+	if existing.PhNumber != previousPhone {
+		delete(r.byPhone, previousPhone)
+		r.byPhone[existing.PhNumber] = user.ID
+	}
+
+	return true, nil
+}
+
+func (r *InMemoryUserRepository) DeleteUser(ctx context.Context, id gocql.UUID, modified models.Modification, expectedVersion int64) (bool, error) {
+	return r.setDeleted(id, modified.At, modified.By, modified, expectedVersion)
+}
+
+func (r *InMemoryUserRepository) RestoreUser(ctx context.Context, id gocql.UUID, modified models.Modification, expectedVersion int64) (bool, error) {
+	return r.setDeleted(id, time.Time{}, "", modified, expectedVersion)
+}
+
+func (r *InMemoryUserRepository) setDeleted(id gocql.UUID, deletedAt time.Time, deletedBy string, modified models.Modification, expectedVersion int64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok || user.Version != expectedVersion {
+		return false, nil
+	}
+
+	user.DeletedAt = deletedAt
+	user.DeletedBy = deletedBy
+	user.UpdatedAt = modified.At
+	user.UpdatedBy = modified.By
+	user.Version = expectedVersion + 1
+	r.users[id] = user
+	return true, nil
+}
+
+func (r *InMemoryUserRepository) PurgeUser(ctx context.Context, id gocql.UUID, expectedVersion int64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok || user.Version != expectedVersion {
+		return false, nil
+	}
+
+	delete(r.users, id)
+	delete(r.byEmail, user.Email)
+	delete(r.byPhone, user.PhNumber)
+	delete(r.accessLog, id)
+	return true, nil
+}
+
+// ListUsers orders users by id and uses the last returned id as page state.
+func (r *InMemoryUserRepository) ListUsers(ctx context.Context, filter *models.UserFilter, pageSize int, pageState []byte) ([]models.User, []byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	deleted := filter != nil && filter.Deleted
+	ids := make([]gocql.UUID, 0, len(r.users))
+	for id := range r.users {
+		if len(pageState) > 0 && bytes.Compare(id.Bytes(), pageState) <= 0 {
+			continue
+		}
+		if r.users[id].DeletedAt.IsZero() == deleted {
+			continue
+		}
+		if filter != nil && !matchesFilter(r.users[id], filter) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	slices.SortFunc(ids, func(a, b gocql.UUID) int {
+		return bytes.Compare(a.Bytes(), b.Bytes())
+	})
+
+	var nextPageState []byte
+	if len(ids) > pageSize {
+		ids = ids[:pageSize]
+		nextPageState = ids[len(ids)-1].Bytes()
+	}
+
+	users := make([]models.User, 0, len(ids))
+	for _, id := range ids {
+		users = append(users, r.users[id])
+	}
+
+	return users, nextPageState, nil
+}
+
+func (r *InMemoryUserRepository) ChangeEmail(ctx context.Context, user *models.User, newEmail, newDisplayEmail, newPhone string, modified models.Modification) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.users[user.ID]
+	if !ok || existing.Version != user.Version {
+		return nil, ErrVersionConflict
+	}
+
+	if owner, ok := r.byEmail[newEmail]; ok && owner != user.ID {
+		return nil, ErrEmailTaken
+	}
+
+	if newPhone == "" {
+		newPhone = existing.PhNumber
+	}
+
+	if owner, ok := r.byPhone[newPhone]; ok && owner != user.ID {
+		return nil, ErrPhoneTaken
+	}
+
+	delete(r.byEmail, existing.Email)
+	delete(r.byPhone, existing.PhNumber)
+
+	existing.Email = newEmail
+	existing.DisplayEmail = newDisplayEmail
+	existing.PhNumber = newPhone
+	existing.UpdatedAt = modified.At
+	existing.UpdatedBy = modified.By
+	existing.Version++
+
+	r.users[user.ID] = existing
+	r.byEmail[newEmail] = user.ID
+	r.byPhone[newPhone] = user.ID
+
+	changed := existing
+	return &changed, nil
+}
+
+// ResumeEmailChanges has nothing to do: email changes are applied under a
+// single lock and cannot be left half done.
+func (r *InMemoryUserRepository) ResumeEmailChanges(ctx context.Context) error {
+	return nil
+}
+
+// ListAccessChanges uses the version of the last returned change as page
+// state.
+func (r *InMemoryUserRepository) ListAccessChanges(ctx context.Context, userID gocql.UUID, pageSize int, pageState []byte) ([]models.AccessChange, []byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	before, err := parseVersionPageState(pageState)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	history := r.accessLog[userID]
+	changes := []models.AccessChange{}
+	for i := len(history) - 1; i >= 0; i-- {
+		if before > 0 && history[i].Version >= before {
+			continue
+		}
+		changes = append(changes, history[i])
+	}
+
+	var nextPageState []byte
+	if len(changes) > pageSize {
+		changes = changes[:pageSize]
+		nextPageState = versionPageState(changes[len(changes)-1].Version)
+	}
+
+	return changes, nextPageState, nil
+}
+
+func (r *InMemoryUserRepository) ListExpiredAccess(ctx context.Context, now time.Time, limit int) ([]models.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	users := []models.User{}
+	for _, user := range r.users {
+		if len(users) == limit {
+			break
+		}
+		if user.DeletedAt.IsZero() && !user.AccessExpiresAt.IsZero() && !user.AccessExpiresAt.After(now) {
+			users = append(users, user)
+		}
+	}
+
+	return users, nil
+}
+
+func (r *InMemoryUserRepository) ListDeletedUsers(ctx context.Context, deletedBefore time.Time, limit int) ([]models.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	users := []models.User{}
+	for _, user := range r.users {
+		if len(users) == limit {
+			break
+		}
+		if !user.DeletedAt.IsZero() && !user.DeletedAt.After(deletedBefore) {
+			users = append(users, user)
+		}
+	}
+
+	return users, nil
+}
+
+func (r *InMemoryUserRepository) get(id gocql.UUID) (*models.User, error) {
+	user, ok := r.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &user, nil
+}
+
+func matchesFilter(user models.User, filter *models.UserFilter) bool {
+	if !slices.Contains(filter.Access, user.Access) || !slices.Contains(filter.Gender, user.Gender) {
+		return false
+	}
+
+	if filter.DobFrom != nil && user.Dob.Before(*filter.DobFrom) {
+		return false
+	}
+
+	if filter.DobTo != nil && user.Dob.After(*filter.DobTo) {
+		return false
+	}
+
+	return true
+}
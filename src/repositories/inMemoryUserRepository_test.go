@@ -0,0 +1,14 @@
+package repositories_test
+
+import (
+	"testing"
+
+	"2k4sm/grpc-crud/src/repositories"
+	"2k4sm/grpc-crud/src/repositories/repositorytest"
+)
+
+func TestInMemoryUserRepository(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repositories.UserRepository {
+		return repositories.NewInMemoryUserRepository()
+	})
+}
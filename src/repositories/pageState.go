@@ -0,0 +1,26 @@
+package repositories
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// versionPageState encodes the version of the last returned history entry as
+// page state for the backends that page by version.
+func versionPageState(version int64) []byte {
+	return []byte(strconv.FormatInt(version, 10))
+}
+
+// parseVersionPageState returns the version a page continues below, or 0 for
+// the first page.
+func parseVersionPageState(pageState []byte) (int64, error) {
+	if len(pageState) == 0 {
+		return 0, nil
+	}
+
+	version, err := strconv.ParseInt(string(pageState), 10, 64)
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidPageState, pageState)
+	}
+	return version, nil
+}
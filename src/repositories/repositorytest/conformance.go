@@ -0,0 +1,1026 @@
+// Package repositorytest holds the behavioural contract every
+// repositories.UserRepository implementation must satisfy.
+//
+// An implementation runs the contract from its own tests by passing a factory
+// that returns an empty repository for every subtest:
+//
+//	func TestInMemoryUserRepository(t *testing.T) {
+//		repositorytest.Run(t, func(t *testing.T) repositories.UserRepository {
+//			return repositories.NewInMemoryUserRepository()
+//		})
+//	}
+//
+// The in-memory and SQLite backends run it on every go test. The ScyllaDB
+// backend runs it when SDB_URI names a cluster it may wipe.
+package repositorytest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"2k4sm/grpc-crud/src/models"
+	"2k4sm/grpc-crud/src/repositories"
+
+	"github.com/gocql/gocql"
+)
+
+type Factory func(t *testing.T) repositories.UserRepository
+
+func Run(t *testing.T, newRepo Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, repo repositories.UserRepository)
+	}{
+		{"CreateAndGet", testCreateAndGet},
+		{"CreateDuplicateEmail", testCreateDuplicateEmail},
+		{"CreateDuplicatePhone", testCreateDuplicatePhone},
+		{"CreateConcurrentDuplicates", testCreateConcurrentDuplicates},
+		{"GetByEmailAndPhone", testGetByEmailAndPhone},
+		{"NotFound", testNotFound},
+		{"UpdateUserAccess", testUpdateUserAccess},
+		{"AccessHistoryPaging", testAccessHistoryPaging},
+		{"ListExpiredAccess", testListExpiredAccess},
+		{"UpdateUserPartialFields", testUpdateUserPartialFields},
+		{"UpdateUserPhone", testUpdateUserPhone},
+		{"UpdateUserVersionConflict", testUpdateUserVersionConflict},
+		{"DeleteUser", testDeleteUser},
+		{"RestoreUser", testRestoreUser},
+		{"PurgeUser", testPurgeUser},
+		{"ListDeletedUsers", testListDeletedUsers},
+		{"ChangeEmail", testChangeEmail},
+		{"ChangeEmailConflicts", testChangeEmailConflicts},
+		{"ListUsersPaging", testListUsersPaging},
+		{"ListUsersFilter", testListUsersFilter},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newRepo(t))
+		})
+	}
+}
+
+// modified is the Modification every update in the suite is made with.
+var modified = models.Modification{
+	At: time.Date(2024, time.March, 1, 12, 30, 0, 0, time.UTC),
+	By: "updater",
+}
+
+func newUser(n int) *models.User {
+	return &models.User{
+		ID:           gocql.TimeUUID(),
+		Email:        fmt.Sprintf("user%d@example.com", n),
+		DisplayEmail: fmt.Sprintf("User%d@Example.com", n),
+		PhNumber:     fmt.Sprintf("+9198765%05d", n),
+		FirstName:    "First",
+		LastName:     "Last",
+		Gender:       "FEMALE",
+		Dob:          time.Date(1990, time.January, 1+n%28, 0, 0, 0, 0, time.UTC),
+		Access:       "UNBLOCKED",
+		Version:      1,
+		CreatedAt:    time.Date(2024, time.January, 1, 8, 0, 0, 0, time.UTC),
+		UpdatedAt:    time.Date(2024, time.January, 1, 8, 0, 0, 0, time.UTC),
+		CreatedBy:    "creator",
+		UpdatedBy:    "creator",
+	}
+}
+
+func mustCreate(t *testing.T, repo repositories.UserRepository, user *models.User) {
+	t.Helper()
+
+	created, err := repo.CreateUser(context.Background(), user)
+	if err != nil {
+		t.Fatalf("CreateUser(%s): %v", user.Email, err)
+	}
+	if !created {
+		t.Fatalf("CreateUser(%s) was not applied", user.Email)
+	}
+}
+
+func assertSameUser(t *testing.T, got, want *models.User) {
+	t.Helper()
+
+	if got.ID != want.ID || got.Email != want.Email || got.DisplayEmail != want.DisplayEmail || got.PhNumber != want.PhNumber ||
+		got.FirstName != want.FirstName || got.LastName != want.LastName || got.Gender != want.Gender ||
+		!got.Dob.Equal(want.Dob) || got.Access != want.Access || !got.AccessExpiresAt.Equal(want.AccessExpiresAt) || got.Version != want.Version ||
+		!got.CreatedAt.Equal(want.CreatedAt) || !got.UpdatedAt.Equal(want.UpdatedAt) || got.CreatedBy != want.CreatedBy || got.UpdatedBy != want.UpdatedBy ||
+		!got.DeletedAt.Equal(want.DeletedAt) || got.DeletedBy != want.DeletedBy {
+		t.Fatalf("got user %+v, want %+v", got, want)
+	}
+}
+
+func assertNotFound(t *testing.T, err error) {
+	t.Helper()
+
+	if !errors.Is(err, repositories.ErrNotFound) {
+		t.Fatalf("got error %v, want %v", err, repositories.ErrNotFound)
+	}
+}
+
+func testCreateAndGet(t *testing.T, repo repositories.UserRepository) {
+	ctx := context.Background()
+	user := newUser(1)
+	mustCreate(t, repo, user)
+
+	byID, err := repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+	assertSameUser(t, byID, user)
+
+	byEmail, err := repo.GetUserByEmail(ctx, user.Email)
+	if err != nil {
+		t.Fatalf("GetUserByEmail: %v", err)
+	}
+	assertSameUser(t, byEmail, user)
+
+	byPhone, err := repo.GetUserByPhone(ctx, user.PhNumber)
+	if err != nil {
+		t.Fatalf("GetUserByPhone: %v", err)
+	}
+	assertSameUser(t, byPhone, user)
+}
+
+func testCreateDuplicateEmail(t *testing.T, repo repositories.UserRepository) {
+	user := newUser(1)
+	mustCreate(t, repo, user)
+
+	duplicate := newUser(2)
+	duplicate.Email = user.Email
+
+	created, err := repo.CreateUser(context.Background(), duplicate)
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if created {
+		t.Fatal("CreateUser with a taken email was applied")
+	}
+
+	_, err = repo.GetUserByPhone(context.Background(), duplicate.PhNumber)
+	assertNotFound(t, err)
+}
+
+func testCreateDuplicatePhone(t *testing.T, repo repositories.UserRepository) {
+	user := newUser(1)
+	mustCreate(t, repo, user)
+
+	duplicate := newUser(2)
+	duplicate.PhNumber = user.PhNumber
+
+	created, err := repo.CreateUser(context.Background(), duplicate)
+	if !errors.Is(err, repositories.ErrPhoneTaken) {
+		t.Fatalf("got error %v, want %v", err, repositories.ErrPhoneTaken)
+	}
+	if created {
+		t.Fatal("CreateUser with a taken phone number was applied")
+	}
+
+	_, err = repo.GetUserByEmail(context.Background(), duplicate.Email)
+	assertNotFound(t, err)
+
+	// The rejected create must not hold on to the email.
+	retry := newUser(3)
+	retry.Email = duplicate.Email
+	mustCreate(t, repo, retry)
+}
+
+// concurrentCreates is how many creates race for the same email or phone
+// number in testCreateConcurrentDuplicates.
+const concurrentCreates = 8
+
+func testCreateConcurrentDuplicates(t *testing.T, repo repositories.UserRepository) {
+	ctx := context.Background()
+
+	race := func(users []*models.User) (winner *models.User) {
+		t.Helper()
+
+		created := make([]bool, len(users))
+		errs := make([]error, len(users))
+
+		var wg sync.WaitGroup
+		for i, user := range users {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				created[i], errs[i] = repo.CreateUser(ctx, user)
+			}()
+		}
+		wg.Wait()
+
+		for i, user := range users {
+			if errs[i] != nil && !errors.Is(errs[i], repositories.ErrPhoneTaken) {
+				t.Fatalf("CreateUser(%s): %v", user.Email, errs[i])
+			}
+			if !created[i] {
+				continue
+			}
+			if winner != nil {
+				t.Fatalf("both %s and %s were created", winner.ID, user.ID)
+			}
+			winner = user
+		}
+
+		if winner == nil {
+			t.Fatal("no create was applied")
+		}
+		return winner
+	}
+
+	sameEmail := make([]*models.User, concurrentCreates)
+	for i := range sameEmail {
+		sameEmail[i] = newUser(100 + i)
+		sameEmail[i].Email = "shared@example.com"
+	}
+
+	winner := race(sameEmail)
+	byEmail, err := repo.GetUserByEmail(ctx, "shared@example.com")
+	if err != nil {
+		t.Fatalf("GetUserByEmail: %v", err)
+	}
+	assertSameUser(t, byEmail, winner)
+
+	for _, user := range sameEmail {
+		if user != winner {
+			_, err := repo.GetUserByPhone(ctx, user.PhNumber)
+			assertNotFound(t, err)
+		}
+	}
+
+	samePhone := make([]*models.User, concurrentCreates)
+	for i := range samePhone {
+		samePhone[i] = newUser(200 + i)
+		samePhone[i].PhNumber = "+919876599999"
+	}
+
+	winner = race(samePhone)
+	byPhone, err := repo.GetUserByPhone(ctx, "+919876599999")
+	if err != nil {
+		t.Fatalf("GetUserByPhone: %v", err)
+	}
+	assertSameUser(t, byPhone, winner)
+
+	for _, user := range samePhone {
+		if user != winner {
+			_, err := repo.GetUserByEmail(ctx, user.Email)
+			assertNotFound(t, err)
+		}
+	}
+}
+
+func testGetByEmailAndPhone(t *testing.T, repo repositories.UserRepository) {
+	ctx := context.Background()
+	user := newUser(1)
+	other := newUser(2)
+	mustCreate(t, repo, user)
+	mustCreate(t, repo, other)
+
+	got, err := repo.GetUserByEmailAndPhone(ctx, user.Email, user.PhNumber)
+	if err != nil {
+		t.Fatalf("GetUserByEmailAndPhone: %v", err)
+	}
+	assertSameUser(t, got, user)
+
+	_, err = repo.GetUserByEmailAndPhone(ctx, user.Email, other.PhNumber)
+	assertNotFound(t, err)
+}
+
+func testNotFound(t *testing.T, repo repositories.UserRepository) {
+	ctx := context.Background()
+
+	_, err := repo.GetUserByID(ctx, gocql.TimeUUID())
+	assertNotFound(t, err)
+
+	_, err = repo.GetUserByEmail(ctx, "missing@example.com")
+	assertNotFound(t, err)
+
+	_, err = repo.GetUserByPhone(ctx, "+10000000000")
+	assertNotFound(t, err)
+
+	_, err = repo.GetUserByEmailAndPhone(ctx, "missing@example.com", "+10000000000")
+	assertNotFound(t, err)
+
+	for name, write := range map[string]func() (bool, error){
+		"DeleteUser":  func() (bool, error) { return repo.DeleteUser(ctx, gocql.TimeUUID(), modified, 1) },
+		"RestoreUser": func() (bool, error) { return repo.RestoreUser(ctx, gocql.TimeUUID(), modified, 1) },
+		"PurgeUser":   func() (bool, error) { return repo.PurgeUser(ctx, gocql.TimeUUID(), 1) },
+	} {
+		applied, err := write()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if applied {
+			t.Fatalf("%s of a missing user was applied", name)
+		}
+	}
+}
+
+// accessChange returns a change made with the suite's modification.
+func accessChange(user *models.User, access string, expiresAt time.Time) *models.AccessChange {
+	return &models.AccessChange{
+		UserID:         user.ID,
+		Access:         access,
+		PreviousAccess: user.Access,
+		Reason:         "reason for " + access,
+		ExpiresAt:      expiresAt,
+		ChangedAt:      modified.At,
+		ChangedBy:      modified.By,
+	}
+}
+
+func testUpdateUserAccess(t *testing.T, repo repositories.UserRepository) {
+	ctx := context.Background()
+	user := newUser(1)
+	mustCreate(t, repo, user)
+
+	expiresAt := time.Date(2024, time.March, 8, 12, 30, 0, 0, time.UTC)
+	change := accessChange(user, "SUSPENDED", expiresAt)
+
+	applied, err := repo.UpdateUserAccess(ctx, change, user.Version)
+	if err != nil {
+		t.Fatalf("UpdateUserAccess: %v", err)
+	}
+	if !applied {
+		t.Fatal("UpdateUserAccess with the current version was not applied")
+	}
+
+	got, err := repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+
+	want := *user
+	want.Access = "SUSPENDED"
+	want.AccessExpiresAt = expiresAt
+	want.UpdatedAt = modified.At
+	want.UpdatedBy = modified.By
+	want.Version = user.Version + 1
+	assertSameUser(t, got, &want)
+
+	applied, err = repo.UpdateUserAccess(ctx, accessChange(&want, "UNBLOCKED", time.Time{}), user.Version)
+	if err != nil {
+		t.Fatalf("UpdateUserAccess: %v", err)
+	}
+	if applied {
+		t.Fatal("UpdateUserAccess with a stale version was applied")
+	}
+
+	changes, _, err := repo.ListAccessChanges(ctx, user.ID, 10, nil)
+	if err != nil {
+		t.Fatalf("ListAccessChanges: %v", err)
+	}
+	if len(changes) != 1 {
+		t.Fatalf("got %d access changes, want 1", len(changes))
+	}
+
+	recorded := changes[0]
+	if recorded.UserID != user.ID || recorded.Version != want.Version || recorded.Access != "SUSPENDED" || recorded.PreviousAccess != "UNBLOCKED" ||
+		recorded.Reason != change.Reason || !recorded.ExpiresAt.Equal(expiresAt) || !recorded.ChangedAt.Equal(modified.At) || recorded.ChangedBy != modified.By {
+		t.Fatalf("got access change %+v, want %+v at version %d", recorded, change, want.Version)
+	}
+}
+
+func testAccessHistoryPaging(t *testing.T, repo repositories.UserRepository) {
+	ctx := context.Background()
+	user := newUser(1)
+	other := newUser(2)
+	mustCreate(t, repo, user)
+	mustCreate(t, repo, other)
+
+	const total = 5
+	states := []string{"BLOCKED", "UNBLOCKED"}
+	current := *user
+	for i := 0; i < total; i++ {
+		change := accessChange(&current, states[i%len(states)], time.Time{})
+		applied, err := repo.UpdateUserAccess(ctx, change, current.Version)
+		if err != nil {
+			t.Fatalf("UpdateUserAccess: %v", err)
+		}
+		if !applied {
+			t.Fatal("UpdateUserAccess with the current version was not applied")
+		}
+		current.Access = change.Access
+		current.Version++
+	}
+
+	// Changes of other users are not part of the history.
+	if _, err := repo.UpdateUserAccess(ctx, accessChange(other, "LOCKED", time.Time{}), other.Version); err != nil {
+		t.Fatalf("UpdateUserAccess: %v", err)
+	}
+
+	var versions []int64
+	var pageState []byte
+	for page := 0; ; page++ {
+		if page > total {
+			t.Fatal("ListAccessChanges did not terminate")
+		}
+
+		changes, next, err := repo.ListAccessChanges(ctx, user.ID, 2, pageState)
+		if err != nil {
+			t.Fatalf("ListAccessChanges: %v", err)
+		}
+		if len(changes) > 2 {
+			t.Fatalf("got page of %d changes, want at most 2", len(changes))
+		}
+
+		for _, change := range changes {
+			if change.UserID != user.ID {
+				t.Fatalf("got change of user %s, want %s", change.UserID, user.ID)
+			}
+			versions = append(versions, change.Version)
+		}
+
+		if len(next) == 0 {
+			break
+		}
+		pageState = next
+	}
+
+	if len(versions) != total {
+		t.Fatalf("listed %d changes, want %d", len(versions), total)
+	}
+	for i, version := range versions {
+		if want := current.Version - int64(i); version != want {
+			t.Fatalf("change %d has version %d, want %d (newest first)", i, version, want)
+		}
+	}
+}
+
+func testListExpiredAccess(t *testing.T, repo repositories.UserRepository) {
+	ctx := context.Background()
+	now := time.Date(2024, time.March, 10, 0, 0, 0, 0, time.UTC)
+
+	expired := newUser(1)
+	due := newUser(2)
+	later := newUser(3)
+	indefinite := newUser(4)
+	renewed := newUser(5)
+	for _, user := range []*models.User{expired, due, later, indefinite, renewed} {
+		mustCreate(t, repo, user)
+	}
+
+	block := func(user *models.User, access string, expiresAt time.Time) {
+		t.Helper()
+
+		current, err := repo.GetUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("GetUserByID: %v", err)
+		}
+
+		applied, err := repo.UpdateUserAccess(ctx, accessChange(current, access, expiresAt), current.Version)
+		if err != nil {
+			t.Fatalf("UpdateUserAccess: %v", err)
+		}
+		if !applied {
+			t.Fatal("UpdateUserAccess with the current version was not applied")
+		}
+	}
+
+	block(expired, "SUSPENDED", now.Add(-time.Hour))
+	block(due, "BLOCKED", now)
+	block(later, "SUSPENDED", now.Add(time.Hour))
+	block(indefinite, "LOCKED", time.Time{})
+	// A block renewed with a later expiry is not due at its first one.
+	block(renewed, "SUSPENDED", now.Add(-time.Hour))
+	block(renewed, "SUSPENDED", now.Add(time.Hour))
+
+	assertExpired := func(want ...*models.User) {
+		t.Helper()
+
+		users, err := repo.ListExpiredAccess(ctx, now, 100)
+		if err != nil {
+			t.Fatalf("ListExpiredAccess: %v", err)
+		}
+
+		got := map[gocql.UUID]bool{}
+		for _, user := range users {
+			got[user.ID] = true
+		}
+
+		if len(got) != len(want) {
+			t.Fatalf("got %d expired users, want %d", len(got), len(want))
+		}
+		for _, user := range want {
+			if !got[user.ID] {
+				t.Fatalf("user %s missing from expired users", user.Email)
+			}
+		}
+	}
+
+	assertExpired(expired, due)
+
+	users, err := repo.ListExpiredAccess(ctx, now, 1)
+	if err != nil {
+		t.Fatalf("ListExpiredAccess: %v", err)
+	}
+	if len(users) != 1 {
+		t.Fatalf("got %d expired users with limit 1, want 1", len(users))
+	}
+
+	// Lifted blocks are no longer due.
+	block(expired, "UNBLOCKED", time.Time{})
+	assertExpired(due)
+
+	// Deleted users keep their block but are not due until restored.
+	current, err := repo.GetUserByID(ctx, due.ID)
+	if err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+	deleted := deleteUser(t, repo, current, now)
+	assertExpired()
+
+	applied, err := repo.RestoreUser(ctx, due.ID, modified, deleted.Version)
+	if err != nil {
+		t.Fatalf("RestoreUser: %v", err)
+	}
+	if !applied {
+		t.Fatal("RestoreUser with the current version was not applied")
+	}
+	assertExpired(due)
+}
+
+func testUpdateUserPartialFields(t *testing.T, repo repositories.UserRepository) {
+	ctx := context.Background()
+	user := newUser(1)
+	mustCreate(t, repo, user)
+
+	update := &models.User{
+		ID:        user.ID,
+		Email:     user.Email,
+		FirstName: "Renamed",
+		LastName:  "Ignored",
+		Gender:    "MALE",
+	}
+
+	applied, err := repo.UpdateUser(ctx, update, []string{"first_name", "gender"}, modified, user.Version)
+	if err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+	if !applied {
+		t.Fatal("UpdateUser with the current version was not applied")
+	}
+
+	got, err := repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+
+	want := *user
+	want.FirstName = "Renamed"
+	want.Gender = "MALE"
+	want.UpdatedAt = modified.At
+	want.UpdatedBy = modified.By
+	want.Version = user.Version + 1
+	assertSameUser(t, got, &want)
+}
+
+func testUpdateUserPhone(t *testing.T, repo repositories.UserRepository) {
+	ctx := context.Background()
+	user := newUser(1)
+	other := newUser(2)
+	mustCreate(t, repo, user)
+	mustCreate(t, repo, other)
+
+	update := *user
+	update.PhNumber = other.PhNumber
+
+	_, err := repo.UpdateUser(ctx, &update, []string{"ph_number"}, modified, user.Version)
+	if !errors.Is(err, repositories.ErrPhoneTaken) {
+		t.Fatalf("got error %v, want %v", err, repositories.ErrPhoneTaken)
+	}
+
+	update.PhNumber = "+15550000000"
+	applied, err := repo.UpdateUser(ctx, &update, []string{"ph_number"}, modified, user.Version)
+	if err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+	if !applied {
+		t.Fatal("UpdateUser with the current version was not applied")
+	}
+
+	got, err := repo.GetUserByPhone(ctx, update.PhNumber)
+	if err != nil {
+		t.Fatalf("GetUserByPhone(new): %v", err)
+	}
+	if got.ID != user.ID {
+		t.Fatalf("new phone number resolves to %s, want %s", got.ID, user.ID)
+	}
+
+	_, err = repo.GetUserByPhone(ctx, user.PhNumber)
+	assertNotFound(t, err)
+
+	// The released number can be registered again.
+	reuse := newUser(3)
+	reuse.PhNumber = user.PhNumber
+	mustCreate(t, repo, reuse)
+}
+
+func testUpdateUserVersionConflict(t *testing.T, repo repositories.UserRepository) {
+	ctx := context.Background()
+	user := newUser(1)
+	mustCreate(t, repo, user)
+
+	update := *user
+	update.FirstName = "Stale"
+
+	applied, err := repo.UpdateUser(ctx, &update, []string{"first_name"}, modified, user.Version+1)
+	if err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+	if applied {
+		t.Fatal("UpdateUser with a stale version was applied")
+	}
+
+	got, err := repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+	assertSameUser(t, got, user)
+}
+
+// deleteUser deletes user at its current version and returns it as stored.
+func deleteUser(t *testing.T, repo repositories.UserRepository, user *models.User, deletedAt time.Time) *models.User {
+	t.Helper()
+
+	ctx := context.Background()
+	applied, err := repo.DeleteUser(ctx, user.ID, models.Modification{At: deletedAt, By: modified.By}, user.Version)
+	if err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if !applied {
+		t.Fatal("DeleteUser with the current version was not applied")
+	}
+
+	deleted, err := repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+	return deleted
+}
+
+func testDeleteUser(t *testing.T, repo repositories.UserRepository) {
+	ctx := context.Background()
+	user := newUser(1)
+	mustCreate(t, repo, user)
+
+	applied, err := repo.DeleteUser(ctx, user.ID, modified, user.Version+1)
+	if err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if applied {
+		t.Fatal("DeleteUser with a stale version was applied")
+	}
+
+	got := deleteUser(t, repo, user, modified.At)
+
+	want := *user
+	want.DeletedAt = modified.At
+	want.DeletedBy = modified.By
+	want.UpdatedAt = modified.At
+	want.UpdatedBy = modified.By
+	want.Version = user.Version + 1
+	assertSameUser(t, got, &want)
+
+	// A deleted user is still found by email and phone number, which stay
+	// taken until the user is purged.
+	if got, err = repo.GetUserByEmail(ctx, user.Email); err != nil {
+		t.Fatalf("GetUserByEmail: %v", err)
+	}
+	assertSameUser(t, got, &want)
+
+	if got, err = repo.GetUserByPhone(ctx, user.PhNumber); err != nil {
+		t.Fatalf("GetUserByPhone: %v", err)
+	}
+	assertSameUser(t, got, &want)
+
+	created, err := repo.CreateUser(ctx, newUser(1))
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if created {
+		t.Fatal("CreateUser with the email of a deleted user was applied")
+	}
+}
+
+func testRestoreUser(t *testing.T, repo repositories.UserRepository) {
+	ctx := context.Background()
+	user := newUser(1)
+	mustCreate(t, repo, user)
+	deleted := deleteUser(t, repo, user, modified.At)
+
+	applied, err := repo.RestoreUser(ctx, user.ID, modified, user.Version)
+	if err != nil {
+		t.Fatalf("RestoreUser: %v", err)
+	}
+	if applied {
+		t.Fatal("RestoreUser with a stale version was applied")
+	}
+
+	restoredAt := models.Modification{At: modified.At.Add(time.Hour), By: "restorer"}
+	applied, err = repo.RestoreUser(ctx, user.ID, restoredAt, deleted.Version)
+	if err != nil {
+		t.Fatalf("RestoreUser: %v", err)
+	}
+	if !applied {
+		t.Fatal("RestoreUser with the current version was not applied")
+	}
+
+	want := *user
+	want.UpdatedAt = restoredAt.At
+	want.UpdatedBy = restoredAt.By
+	want.Version = deleted.Version + 1
+
+	got, err := repo.GetUserByEmail(ctx, user.Email)
+	if err != nil {
+		t.Fatalf("GetUserByEmail: %v", err)
+	}
+	assertSameUser(t, got, &want)
+}
+
+func testPurgeUser(t *testing.T, repo repositories.UserRepository) {
+	ctx := context.Background()
+	user := newUser(1)
+	mustCreate(t, repo, user)
+
+	if _, err := repo.UpdateUserAccess(ctx, accessChange(user, "BLOCKED", time.Time{}), user.Version); err != nil {
+		t.Fatalf("UpdateUserAccess: %v", err)
+	}
+
+	current, err := repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+	deleted := deleteUser(t, repo, current, modified.At)
+
+	applied, err := repo.PurgeUser(ctx, user.ID, current.Version)
+	if err != nil {
+		t.Fatalf("PurgeUser: %v", err)
+	}
+	if applied {
+		t.Fatal("PurgeUser with a stale version was applied")
+	}
+
+	applied, err = repo.PurgeUser(ctx, user.ID, deleted.Version)
+	if err != nil {
+		t.Fatalf("PurgeUser: %v", err)
+	}
+	if !applied {
+		t.Fatal("PurgeUser with the current version was not applied")
+	}
+
+	// The access history goes with the user.
+	changes, _, err := repo.ListAccessChanges(ctx, user.ID, 10, nil)
+	if err != nil {
+		t.Fatalf("ListAccessChanges: %v", err)
+	}
+	if len(changes) != 0 {
+		t.Fatalf("got %d access changes after purge, want 0", len(changes))
+	}
+
+	_, err = repo.GetUserByID(ctx, user.ID)
+	assertNotFound(t, err)
+
+	_, err = repo.GetUserByEmail(ctx, user.Email)
+	assertNotFound(t, err)
+
+	_, err = repo.GetUserByPhone(ctx, user.PhNumber)
+	assertNotFound(t, err)
+
+	// Email and phone number are free again after a purge.
+	again := newUser(1)
+	mustCreate(t, repo, again)
+}
+
+func testListDeletedUsers(t *testing.T, repo repositories.UserRepository) {
+	ctx := context.Background()
+	cutoff := time.Date(2024, time.March, 10, 0, 0, 0, 0, time.UTC)
+
+	old := newUser(1)
+	due := newUser(2)
+	recent := newUser(3)
+	live := newUser(4)
+	restored := newUser(5)
+	for _, user := range []*models.User{old, due, recent, live, restored} {
+		mustCreate(t, repo, user)
+	}
+
+	deleteUser(t, repo, old, cutoff.Add(-time.Hour))
+	deleteUser(t, repo, due, cutoff)
+	deleteUser(t, repo, recent, cutoff.Add(time.Hour))
+
+	// A restored user is not due at its earlier deletion.
+	deleted := deleteUser(t, repo, restored, cutoff.Add(-time.Hour))
+	if _, err := repo.RestoreUser(ctx, restored.ID, modified, deleted.Version); err != nil {
+		t.Fatalf("RestoreUser: %v", err)
+	}
+
+	users, err := repo.ListDeletedUsers(ctx, cutoff, 100)
+	if err != nil {
+		t.Fatalf("ListDeletedUsers: %v", err)
+	}
+
+	got := map[gocql.UUID]bool{}
+	for _, user := range users {
+		got[user.ID] = true
+	}
+
+	if len(got) != 2 || !got[old.ID] || !got[due.ID] {
+		t.Fatalf("got deleted users %v, want %s and %s", users, old.Email, due.Email)
+	}
+
+	users, err = repo.ListDeletedUsers(ctx, cutoff, 1)
+	if err != nil {
+		t.Fatalf("ListDeletedUsers: %v", err)
+	}
+	if len(users) != 1 {
+		t.Fatalf("got %d deleted users with limit 1, want 1", len(users))
+	}
+}
+
+func testChangeEmail(t *testing.T, repo repositories.UserRepository) {
+	ctx := context.Background()
+	user := newUser(1)
+	mustCreate(t, repo, user)
+
+	changed, err := repo.ChangeEmail(ctx, user, "renamed@example.com", "Renamed@Example.com", "+15551111111", modified)
+	if err != nil {
+		t.Fatalf("ChangeEmail: %v", err)
+	}
+
+	want := *user
+	want.Email = "renamed@example.com"
+	want.DisplayEmail = "Renamed@Example.com"
+	want.PhNumber = "+15551111111"
+	want.UpdatedAt = modified.At
+	want.UpdatedBy = modified.By
+	want.Version = user.Version + 1
+	assertSameUser(t, changed, &want)
+
+	got, err := repo.GetUserByEmail(ctx, want.Email)
+	if err != nil {
+		t.Fatalf("GetUserByEmail(new): %v", err)
+	}
+	assertSameUser(t, got, &want)
+
+	_, err = repo.GetUserByEmail(ctx, user.Email)
+	assertNotFound(t, err)
+
+	_, err = repo.GetUserByPhone(ctx, user.PhNumber)
+	assertNotFound(t, err)
+}
+
+func testChangeEmailConflicts(t *testing.T, repo repositories.UserRepository) {
+	ctx := context.Background()
+	user := newUser(1)
+	other := newUser(2)
+	mustCreate(t, repo, user)
+	mustCreate(t, repo, other)
+
+	if _, err := repo.ChangeEmail(ctx, user, other.Email, other.DisplayEmail, "", modified); !errors.Is(err, repositories.ErrEmailTaken) {
+		t.Fatalf("got error %v, want %v", err, repositories.ErrEmailTaken)
+	}
+
+	if _, err := repo.ChangeEmail(ctx, user, "free@example.com", "free@example.com", other.PhNumber, modified); !errors.Is(err, repositories.ErrPhoneTaken) {
+		t.Fatalf("got error %v, want %v", err, repositories.ErrPhoneTaken)
+	}
+
+	stale := *user
+	stale.Version = user.Version + 1
+	if _, err := repo.ChangeEmail(ctx, &stale, "free@example.com", "free@example.com", "", modified); !errors.Is(err, repositories.ErrVersionConflict) {
+		t.Fatalf("got error %v, want %v", err, repositories.ErrVersionConflict)
+	}
+
+	got, err := repo.GetUserByEmail(ctx, user.Email)
+	if err != nil {
+		t.Fatalf("GetUserByEmail: %v", err)
+	}
+	assertSameUser(t, got, user)
+
+	_, err = repo.GetUserByEmail(ctx, "free@example.com")
+	assertNotFound(t, err)
+}
+
+func testListUsersPaging(t *testing.T, repo repositories.UserRepository) {
+	const total = 7
+
+	want := map[gocql.UUID]bool{}
+	for i := 0; i < total; i++ {
+		user := newUser(i)
+		mustCreate(t, repo, user)
+		want[user.ID] = true
+	}
+
+	seen := map[gocql.UUID]bool{}
+	var pageState []byte
+	for page := 0; ; page++ {
+		if page > total {
+			t.Fatal("ListUsers did not terminate")
+		}
+
+		users, next, err := repo.ListUsers(context.Background(), nil, 3, pageState)
+		if err != nil {
+			t.Fatalf("ListUsers: %v", err)
+		}
+		if len(users) > 3 {
+			t.Fatalf("got page of %d users, want at most 3", len(users))
+		}
+
+		for _, user := range users {
+			if seen[user.ID] {
+				t.Fatalf("user %s listed twice", user.ID)
+			}
+			seen[user.ID] = true
+		}
+
+		if len(next) == 0 {
+			break
+		}
+		pageState = next
+	}
+
+	if len(seen) != len(want) {
+		t.Fatalf("listed %d users, want %d", len(seen), len(want))
+	}
+}
+
+func testListUsersFilter(t *testing.T, repo repositories.UserRepository) {
+	blocked := newUser(1)
+	blocked.Access = "BLOCKED"
+	blocked.Dob = time.Date(1985, time.June, 1, 0, 0, 0, 0, time.UTC)
+
+	male := newUser(2)
+	male.Gender = "MALE"
+	male.Dob = time.Date(1995, time.June, 1, 0, 0, 0, 0, time.UTC)
+
+	young := newUser(3)
+	young.Dob = time.Date(2005, time.June, 1, 0, 0, 0, 0, time.UTC)
+
+	deleted := newUser(4)
+	deleted.Dob = time.Date(1990, time.June, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, user := range []*models.User{blocked, male, young, deleted} {
+		mustCreate(t, repo, user)
+	}
+	deleteUser(t, repo, deleted, modified.At)
+
+	from := time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		filter *models.UserFilter
+		want   []*models.User
+	}{
+		{
+			name:   "access",
+			filter: &models.UserFilter{Access: []string{"BLOCKED"}, Gender: []string{"MALE", "FEMALE"}},
+			want:   []*models.User{blocked},
+		},
+		{
+			name:   "gender",
+			filter: &models.UserFilter{Access: []string{"BLOCKED", "UNBLOCKED"}, Gender: []string{"MALE"}},
+			want:   []*models.User{male},
+		},
+		{
+			name:   "dob range",
+			filter: &models.UserFilter{Access: []string{"BLOCKED", "UNBLOCKED"}, Gender: []string{"MALE", "FEMALE"}, DobFrom: &from, DobTo: &to},
+			want:   []*models.User{blocked, male},
+		},
+		{
+			name:   "no filter",
+			filter: nil,
+			want:   []*models.User{blocked, male, young},
+		},
+		{
+			name:   "deleted",
+			filter: &models.UserFilter{Access: []string{"BLOCKED", "UNBLOCKED"}, Gender: []string{"MALE", "FEMALE"}, Deleted: true},
+			want:   []*models.User{deleted},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, _, err := repo.ListUsers(context.Background(), tt.filter, 100, nil)
+			if err != nil {
+				t.Fatalf("ListUsers: %v", err)
+			}
+
+			got := map[gocql.UUID]bool{}
+			for _, user := range users {
+				got[user.ID] = true
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d users, want %d", len(got), len(tt.want))
+			}
+			for _, user := range tt.want {
+				if !got[user.ID] {
+					t.Fatalf("user %s missing from result", user.Email)
+				}
+			}
+		})
+	}
+}
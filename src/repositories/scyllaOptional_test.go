@@ -0,0 +1,5 @@
+//go:build !scylla
+
+package repositories_test
+
+const scyllaRequired = false
@@ -0,0 +1,8 @@
+//go:build scylla
+
+package repositories_test
+
+// scyllaRequired fails TestScyllaUserRepository instead of skipping it when
+// SDB_URI is not set, so that a run built with the scylla tag cannot pass
+// without covering the ScyllaDB backend.
+const scyllaRequired = true
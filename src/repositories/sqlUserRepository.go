@@ -0,0 +1,483 @@
+package repositories
+
+import (
+	"2k4sm/grpc-crud/src/models"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+const (
+	sqlUserColumns         = "id, email, display_email, ph_number, first_name, last_name, gender, dob, access, access_expires_at, version, created_at, updated_at, created_by, updated_by, deleted_at, deleted_by"
+	sqlAccessChangeColumns = "user_id, version, access, previous_access, reason, expires_at, changed_at, changed_by"
+)
+
+// SQLUserRepository stores users in a single SQL table for deployments that
+// do not run ScyllaDB. Queries use $N placeholders, which both SQLite and
+// PostgreSQL accept. Uniqueness of email and phone is backed by unique
+// constraints and multi-statement writes run in transactions, so email changes
+// need no journal.
+type SQLUserRepository struct {
+	db *sql.DB
+}
+
+func NewSQLUserRepository(db *sql.DB) UserRepository {
+	return &SQLUserRepository{
+		db: db,
+	}
+}
+
+func (r *SQLUserRepository) CreateUser(ctx context.Context, user *models.User) (bool, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, sqlError(err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `INSERT INTO users (`+sqlUserColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+		ON CONFLICT DO NOTHING`,
+		user.ID.String(), user.Email, user.DisplayEmail, user.PhNumber, user.FirstName, user.LastName, user.Gender, user.Dob, user.Access, nullTime(user.AccessExpiresAt), user.Version,
+		user.CreatedAt, user.UpdatedAt, user.CreatedBy, user.UpdatedBy, nullTime(user.DeletedAt), user.DeletedBy)
+	if err != nil {
+		return false, sqlError(err)
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, sqlError(err)
+	}
+
+	if inserted == 0 {
+		emailTaken, err := r.exists(ctx, tx, "email", user.Email, user.ID)
+		if err != nil {
+			return false, sqlError(err)
+		}
+		if emailTaken {
+			return false, nil
+		}
+		return false, ErrPhoneTaken
+	}
+
+	return true, sqlError(tx.Commit())
+}
+
+func (r *SQLUserRepository) GetUserByID(ctx context.Context, id gocql.UUID) (*models.User, error) {
+	return r.getUser(ctx, "id = $1", id.String())
+}
+
+func (r *SQLUserRepository) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	return r.getUser(ctx, "email = $1", email)
+}
+
+func (r *SQLUserRepository) GetUserByPhone(ctx context.Context, phone string) (*models.User, error) {
+	return r.getUser(ctx, "ph_number = $1", phone)
+}
+
+func (r *SQLUserRepository) GetUserByEmailAndPhone(ctx context.Context, email, phone string) (*models.User, error) {
+	return r.getUser(ctx, "email = $1 AND ph_number = $2", email, phone)
+}
+
+func (r *SQLUserRepository) UpdateUserAccess(ctx context.Context, change *models.AccessChange, expectedVersion int64) (bool, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, sqlError(err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `UPDATE users SET access = $1, access_expires_at = $2, updated_at = $3, updated_by = $4, version = $5
+		WHERE id = $6 AND version = $7`,
+		change.Access, nullTime(change.ExpiresAt), change.ChangedAt, change.ChangedBy, expectedVersion+1, change.UserID.String(), expectedVersion)
+	if err != nil {
+		return false, sqlError(err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil || updated == 0 {
+		return false, sqlError(err)
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO user_access_changes (`+sqlAccessChangeColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		change.UserID.String(), expectedVersion+1, change.Access, change.PreviousAccess, change.Reason, nullTime(change.ExpiresAt), change.ChangedAt, change.ChangedBy)
+	if err != nil {
+		return false, sqlError(err)
+	}
+
+	return true, sqlError(tx.Commit())
+}
+
+func (r *SQLUserRepository) UpdateUser(ctx context.Context, user *models.User, fields []string, modified models.Modification, expectedVersion int64) (bool, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, sqlError(err)
+	}
+	defer tx.Rollback()
+
+	assignments := make([]string, 0, len(fields)+3)
+	args := make([]interface{}, 0, len(fields)+5)
+
+	for _, field := range fields {
+		var value interface{}
+		switch field {
+		case "first_name":
+			value = user.FirstName
+		case "last_name":
+			value = user.LastName
+		case "ph_number":
+			taken, err := r.exists(ctx, tx, "ph_number", user.PhNumber, user.ID)
+			if err != nil {
+				return false, sqlError(err)
+			}
+			if taken {
+				return false, ErrPhoneTaken
+			}
+			value = user.PhNumber
+		case "gender":
+			value = user.Gender
+		case "dob":
+			value = user.Dob
+		default:
+			return false, fmt.Errorf("unknown user field %q", field)
+		}
+
+		args = append(args, value)
+		assignments = append(assignments, fmt.Sprintf("%s = $%d", field, len(args)))
+	}
+
+	args = append(args, modified.At)
+	assignments = append(assignments, fmt.Sprintf("updated_at = $%d", len(args)))
+	args = append(args, modified.By)
+	assignments = append(assignments, fmt.Sprintf("updated_by = $%d", len(args)))
+	args = append(args, expectedVersion+1)
+	assignments = append(assignments, fmt.Sprintf("version = $%d", len(args)))
+	args = append(args, user.ID.String(), expectedVersion)
+
+	result, err := tx.ExecContext(ctx, fmt.Sprintf("UPDATE users SET %s WHERE id = $%d AND version = $%d",
+		strings.Join(assignments, ", "), len(args)-1, len(args)), args...)
+	if err != nil {
+		return false, sqlError(err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil || updated == 0 {
+		return false, sqlError(err)
+	}
+
+	return true, sqlError(tx.Commit())
+}
+
+func (r *SQLUserRepository) DeleteUser(ctx context.Context, id gocql.UUID, modified models.Modification, expectedVersion int64) (bool, error) {
+	return r.setDeleted(ctx, id, modified.At, modified.By, modified, expectedVersion)
+}
+
+func (r *SQLUserRepository) RestoreUser(ctx context.Context, id gocql.UUID, modified models.Modification, expectedVersion int64) (bool, error) {
+	return r.setDeleted(ctx, id, time.Time{}, "", modified, expectedVersion)
+}
+
+func (r *SQLUserRepository) setDeleted(ctx context.Context, id gocql.UUID, deletedAt time.Time, deletedBy string, modified models.Modification, expectedVersion int64) (bool, error) {
+	result, err := r.db.ExecContext(ctx, `UPDATE users SET deleted_at = $1, deleted_by = $2, updated_at = $3, updated_by = $4, version = $5
+		WHERE id = $6 AND version = $7`,
+		nullTime(deletedAt), deletedBy, modified.At, modified.By, expectedVersion+1, id.String(), expectedVersion)
+	if err != nil {
+		return false, sqlError(err)
+	}
+
+	updated, err := result.RowsAffected()
+	return updated > 0, sqlError(err)
+}
+
+func (r *SQLUserRepository) PurgeUser(ctx context.Context, id gocql.UUID, expectedVersion int64) (bool, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, sqlError(err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1 AND version = $2`, id.String(), expectedVersion)
+	if err != nil {
+		return false, sqlError(err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil || deleted == 0 {
+		return false, sqlError(err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_access_changes WHERE user_id = $1`, id.String()); err != nil {
+		return false, sqlError(err)
+	}
+
+	return true, sqlError(tx.Commit())
+}
+
+// ListUsers pages through users ordered by id, using the last returned id as
+// page state.
+func (r *SQLUserRepository) ListUsers(ctx context.Context, filter *models.UserFilter, pageSize int, pageState []byte) ([]models.User, []byte, error) {
+	conditions := []string{}
+	args := []interface{}{}
+
+	if len(pageState) > 0 {
+		args = append(args, string(pageState))
+		conditions = append(conditions, fmt.Sprintf("id > $%d", len(args)))
+	}
+
+	if filter != nil && filter.Deleted {
+		conditions = append(conditions, "deleted_at IS NOT NULL")
+	} else {
+		conditions = append(conditions, "deleted_at IS NULL")
+	}
+
+	if filter != nil {
+		conditions = append(conditions, "access IN ("+placeholders(&args, filter.Access)+")")
+		conditions = append(conditions, "gender IN ("+placeholders(&args, filter.Gender)+")")
+
+		if filter.DobFrom != nil {
+			args = append(args, *filter.DobFrom)
+			conditions = append(conditions, fmt.Sprintf("dob >= $%d", len(args)))
+		}
+
+		if filter.DobTo != nil {
+			args = append(args, *filter.DobTo)
+			conditions = append(conditions, fmt.Sprintf("dob <= $%d", len(args)))
+		}
+	}
+
+	query := "SELECT " + sqlUserColumns + " FROM users WHERE " + strings.Join(conditions, " AND ")
+
+	args = append(args, pageSize+1)
+	query += fmt.Sprintf(" ORDER BY id LIMIT $%d", len(args))
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, nil, sqlError(err)
+	}
+	defer rows.Close()
+
+	var users []models.User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, nil, sqlError(err)
+		}
+		users = append(users, *user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, nil, sqlError(err)
+	}
+
+	var nextPageState []byte
+	if len(users) > pageSize {
+		users = users[:pageSize]
+		nextPageState = []byte(users[len(users)-1].ID.String())
+	}
+
+	return users, nextPageState, nil
+}
+
+func (r *SQLUserRepository) ChangeEmail(ctx context.Context, user *models.User, newEmail, newDisplayEmail, newPhone string, modified models.Modification) (*models.User, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, sqlError(err)
+	}
+	defer tx.Rollback()
+
+	emailTaken, err := r.exists(ctx, tx, "email", newEmail, user.ID)
+	if err != nil {
+		return nil, sqlError(err)
+	}
+	if emailTaken {
+		return nil, ErrEmailTaken
+	}
+
+	if newPhone == "" {
+		newPhone = user.PhNumber
+	}
+
+	phoneTaken, err := r.exists(ctx, tx, "ph_number", newPhone, user.ID)
+	if err != nil {
+		return nil, sqlError(err)
+	}
+	if phoneTaken {
+		return nil, ErrPhoneTaken
+	}
+
+	result, err := tx.ExecContext(ctx, `UPDATE users SET email = $1, display_email = $2, ph_number = $3, updated_at = $4, updated_by = $5, version = $6
+		WHERE id = $7 AND version = $8`,
+		newEmail, newDisplayEmail, newPhone, modified.At, modified.By, user.Version+1, user.ID.String(), user.Version)
+	if err != nil {
+		return nil, sqlError(err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return nil, sqlError(err)
+	}
+	if updated == 0 {
+		return nil, ErrVersionConflict
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, sqlError(err)
+	}
+
+	changed := *user
+	changed.Email = newEmail
+	changed.DisplayEmail = newDisplayEmail
+	changed.PhNumber = newPhone
+	changed.UpdatedAt = modified.At
+	changed.UpdatedBy = modified.By
+	changed.Version = user.Version + 1
+	return &changed, nil
+}
+
+// ResumeEmailChanges has nothing to do: email changes commit in a single
+// transaction and cannot be left half done.
+func (r *SQLUserRepository) ResumeEmailChanges(ctx context.Context) error {
+	return nil
+}
+
+// ListAccessChanges uses the version of the last returned change as page
+// state.
+func (r *SQLUserRepository) ListAccessChanges(ctx context.Context, userID gocql.UUID, pageSize int, pageState []byte) ([]models.AccessChange, []byte, error) {
+	before, err := parseVersionPageState(pageState)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	query := "SELECT " + sqlAccessChangeColumns + " FROM user_access_changes WHERE user_id = $1"
+	args := []interface{}{userID.String()}
+
+	if before > 0 {
+		args = append(args, before)
+		query += fmt.Sprintf(" AND version < $%d", len(args))
+	}
+
+	args = append(args, pageSize+1)
+	query += fmt.Sprintf(" ORDER BY version DESC LIMIT $%d", len(args))
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, nil, sqlError(err)
+	}
+	defer rows.Close()
+
+	var changes []models.AccessChange
+	for rows.Next() {
+		var change models.AccessChange
+		var id string
+		var expiresAt sql.NullTime
+
+		err := rows.Scan(&id, &change.Version, &change.Access, &change.PreviousAccess, &change.Reason, &expiresAt, &change.ChangedAt, &change.ChangedBy)
+		if err != nil {
+			return nil, nil, sqlError(err)
+		}
+
+		change.ExpiresAt = expiresAt.Time
+		if change.UserID, err = gocql.ParseUUID(id); err != nil {
+			return nil, nil, sqlError(err)
+		}
+		changes = append(changes, change)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, nil, sqlError(err)
+	}
+
+	var nextPageState []byte
+	if len(changes) > pageSize {
+		changes = changes[:pageSize]
+		nextPageState = versionPageState(changes[len(changes)-1].Version)
+	}
+
+	return changes, nextPageState, nil
+}
+
+func (r *SQLUserRepository) ListExpiredAccess(ctx context.Context, now time.Time, limit int) ([]models.User, error) {
+	return r.dueUsers(ctx, "access_expires_at", "deleted_at IS NULL", now, limit)
+}
+
+func (r *SQLUserRepository) ListDeletedUsers(ctx context.Context, deletedBefore time.Time, limit int) ([]models.User, error) {
+	return r.dueUsers(ctx, "deleted_at", "deleted_at IS NOT NULL", deletedBefore, limit)
+}
+
+// dueUsers returns up to limit users matching condition whose timestamp column
+// is set and at or before now, earliest first.
+func (r *SQLUserRepository) dueUsers(ctx context.Context, column, condition string, now time.Time, limit int) ([]models.User, error) {
+	rows, err := r.db.QueryContext(ctx, fmt.Sprintf("SELECT "+sqlUserColumns+` FROM users
+		WHERE %[1]s IS NOT NULL AND %[1]s <= $1 AND %[2]s
+		ORDER BY %[1]s LIMIT $2`, column, condition), now.UTC(), limit)
+	if err != nil {
+		return nil, sqlError(err)
+	}
+	defer rows.Close()
+
+	var users []models.User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, sqlError(err)
+		}
+		users = append(users, *user)
+	}
+
+	return users, sqlError(rows.Err())
+}
+
+func (r *SQLUserRepository) getUser(ctx context.Context, condition string, args ...interface{}) (*models.User, error) {
+	row := r.db.QueryRowContext(ctx, "SELECT "+sqlUserColumns+" FROM users WHERE "+condition, args...)
+
+	user, err := scanUser(row)
+	return user, sqlError(err)
+}
+
+// exists reports whether another user than id already has value in column.
+func (r *SQLUserRepository) exists(ctx context.Context, tx *sql.Tx, column, value string, id gocql.UUID) (bool, error) {
+	var count int
+	err := tx.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM users WHERE %s = $1 AND id <> $2", column),
+		value, id.String()).Scan(&count)
+	return count > 0, sqlError(err)
+}
+
+func scanUser(row interface{ Scan(...interface{}) error }) (*models.User, error) {
+	var user models.User
+	var id string
+	var accessExpiresAt, createdAt, updatedAt, deletedAt sql.NullTime
+
+	err := row.Scan(&id, &user.Email, &user.DisplayEmail, &user.PhNumber, &user.FirstName, &user.LastName, &user.Gender, &user.Dob, &user.Access, &accessExpiresAt, &user.Version,
+		&createdAt, &updatedAt, &user.CreatedBy, &user.UpdatedBy, &deletedAt, &user.DeletedBy)
+	if err != nil {
+		return nil, sqlError(err)
+	}
+
+	// Users stored before timestamps were recorded have NULL ones.
+	user.AccessExpiresAt = accessExpiresAt.Time
+	user.CreatedAt = createdAt.Time
+	user.UpdatedAt = updatedAt.Time
+	user.DeletedAt = deletedAt.Time
+
+	if user.ID, err = gocql.ParseUUID(id); err != nil {
+		return nil, sqlError(err)
+	}
+
+	return &user, nil
+}
+
+// nullTime stores a zero time, which stands for "never", as NULL.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func placeholders(args *[]interface{}, values []string) string {
+	marks := make([]string, len(values))
+	for i, value := range values {
+		*args = append(*args, value)
+		marks[i] = fmt.Sprintf("$%d", len(*args))
+	}
+	return strings.Join(marks, ", ")
+}
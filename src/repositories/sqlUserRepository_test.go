@@ -0,0 +1,19 @@
+package repositories_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"2k4sm/grpc-crud/src/db"
+	"2k4sm/grpc-crud/src/repositories"
+	"2k4sm/grpc-crud/src/repositories/repositorytest"
+)
+
+func TestSQLiteUserRepository(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repositories.UserRepository {
+		sqlDb := db.InitSQLDb("sqlite", filepath.Join(t.TempDir(), "users.db"))
+		t.Cleanup(func() { sqlDb.Close() })
+
+		return repositories.NewSQLUserRepository(sqlDb)
+	})
+}
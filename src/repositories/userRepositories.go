@@ -3,7 +3,12 @@ package repositories
 import (
 	"2k4sm/grpc-crud/src/models"
 	"context"
+	"errors"
+	"hash/fnv"
+	"slices"
+	"time"
 
+	"github.com/gocql/gocql"
 	"github.com/scylladb/gocqlx/qb"
 	"github.com/scylladb/gocqlx/table"
 	"github.com/scylladb/gocqlx/v2"
@@ -11,102 +16,235 @@ import (
 
 type UserRepository interface {
 	CreateUser(ctx context.Context, user *models.User) (bool, error)
+	GetUserByID(ctx context.Context, id gocql.UUID) (*models.User, error)
 	GetUserByEmail(ctx context.Context, email string) (*models.User, error)
 	GetUserByPhone(ctx context.Context, phone string) (*models.User, error)
 	GetUserByEmailAndPhone(ctx context.Context, email, phone string) (*models.User, error)
-	UpdateUserAccess(ctx context.Context, email string, access string) error
-	UpdateUser(ctx context.Context, user *models.User, fields []string) error
-	DeleteUser(ctx context.Context, email string) error
+	// UpdateUserAccess moves the user to change.Access and appends change to
+	// its access history, stamped with the version the write produced.
+	UpdateUserAccess(ctx context.Context, change *models.AccessChange, expectedVersion int64) (bool, error)
+	UpdateUser(ctx context.Context, user *models.User, fields []string, modified models.Modification, expectedVersion int64) (bool, error)
+	// DeleteUser marks the user deleted. Deleted users keep their email and
+	// phone number, so that RestoreUser can always bring them back, until
+	// PurgeUser removes them for good.
+	DeleteUser(ctx context.Context, id gocql.UUID, modified models.Modification, expectedVersion int64) (bool, error)
+	RestoreUser(ctx context.Context, id gocql.UUID, modified models.Modification, expectedVersion int64) (bool, error)
+	// PurgeUser permanently removes the user together with its lookups and
+	// access history.
+	PurgeUser(ctx context.Context, id gocql.UUID, expectedVersion int64) (bool, error)
+	// ListUsers leaves deleted users out unless filter.Deleted asks for only
+	// them.
+	ListUsers(ctx context.Context, filter *models.UserFilter, pageSize int, pageState []byte) ([]models.User, []byte, error)
+	ChangeEmail(ctx context.Context, user *models.User, newEmail, newDisplayEmail, newPhone string, modified models.Modification) (*models.User, error)
+	ResumeEmailChanges(ctx context.Context) error
+	// ListAccessChanges pages through the access history of a user, newest
+	// change first.
+	ListAccessChanges(ctx context.Context, userID gocql.UUID, pageSize int, pageState []byte) ([]models.AccessChange, []byte, error)
+	// ListExpiredAccess returns up to limit users whose block ended at or
+	// before now and has not been lifted yet. Deleted users are left out
+	// until they are restored.
+	ListExpiredAccess(ctx context.Context, now time.Time, limit int) ([]models.User, error)
+	// ListDeletedUsers returns up to limit users deleted at or before
+	// deletedBefore.
+	ListDeletedUsers(ctx context.Context, deletedBefore time.Time, limit int) ([]models.User, error)
 }
 
+// dueTableShards is the number of partitions catalog.access_expiries and
+// catalog.deleted_users are spread over.
+const dueTableShards = 16
+
+// lookupClaimGrace is how long an email or phone registration that no user
+// row confirms yet is left to the write that made it before another user may
+// take it over.
+const lookupClaimGrace = time.Minute
+
+// UserRepositoryImpl stores users in catalog.users_by_id, keyed by an
+// immutable id. Email and phone lookups go through the users_by_email and
+// users_by_phone tables; a lookup is only trusted when the user row it points
+// to still carries the same value, so entries left behind by an interrupted
+// write are treated as missing.
 type UserRepositoryImpl struct {
-	session *gocqlx.Session
-	table   *table.Table
+	session      *gocqlx.Session
+	table        *table.Table
+	emailLookup  *table.Table
+	phoneLookup  *table.Table
+	filterView   *table.Table
+	emailChanges *table.Table
+	accessLog    *table.Table
+	expiries     *table.Table
+	deletions    *table.Table
 }
 
 func NewUserRepository(session *gocqlx.Session) UserRepository {
 	return &UserRepositoryImpl{
-		session: session,
-		table:   table.New(models.UserMetadata),
+		session:      session,
+		table:        table.New(models.UserMetadata),
+		emailLookup:  table.New(models.EmailLookupMetadata),
+		phoneLookup:  table.New(models.PhoneLookupMetadata),
+		filterView:   table.New(models.UsersByAccessGenderMetadata),
+		emailChanges: table.New(models.EmailChangeMetadata),
+		accessLog:    table.New(models.AccessChangeMetadata),
+		expiries:     table.New(models.AccessExpiryMetadata),
+		deletions:    table.New(models.UserDeletionMetadata),
 	}
 }
 
 func (r *UserRepositoryImpl) CreateUser(ctx context.Context, user *models.User) (bool, error) {
+	claimed, err := r.claimEmail(ctx, user.Email, user.ID)
+	if err != nil || !claimed {
+		return false, err
+	}
+
+	claimed, err = r.claimPhone(ctx, user.PhNumber, user.ID)
+	if err != nil || !claimed {
+		if releaseErr := r.clearLookup(r.emailLookup, "email", user.Email, user.ID); releaseErr != nil {
+			return false, releaseErr
+		}
+		if err != nil {
+			return false, err
+		}
+		return false, ErrPhoneTaken
+	}
+
 	stmt, names := qb.Insert(r.table.Name()).
-		Columns("email", "first_name", "last_name", "ph_number", "gender", "dob", "access").
-		Unique().
+		Columns(models.UserMetadata.Columns...).
 		ToCql()
 
-	executor := r.session.Query(stmt, names).BindStruct(user)
-	return executor.ExecCASRelease()
+	if err := r.session.Query(stmt, names).BindStruct(user).ExecRelease(); err != nil {
+		return false, scyllaError(err)
+	}
+
+	return true, nil
 }
 
-func (r *UserRepositoryImpl) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+func (r *UserRepositoryImpl) GetUserByID(ctx context.Context, id gocql.UUID) (*models.User, error) {
 	stmt, names := qb.Select(r.table.Name()).
-		Columns("email", "first_name", "last_name", "ph_number", "gender", "dob", "access").
-		Where(qb.Eq("email")).
+		Columns(models.UserMetadata.Columns...).
+		Where(qb.Eq("id")).
 		ToCql()
 
-	executor := r.session.Query(stmt, names).BindMap(qb.M{"email": email})
+	executor := r.session.Query(stmt, names).BindMap(qb.M{"id": id})
 
 	var user models.User
 	if err := executor.GetRelease(&user); err != nil {
-		return nil, err
+		return nil, scyllaError(err)
 	}
 
 	return &user, nil
 }
 
-func (r *UserRepositoryImpl) GetUserByPhone(ctx context.Context, phone string) (*models.User, error) {
-	stmt, names := qb.Select(r.table.Name()).
-		Columns("email", "first_name", "last_name", "ph_number", "gender", "dob", "access").
-		Where(qb.Eq("ph_number")).
-		ToCql()
-
-	executor := r.session.Query(stmt, names).BindMap(qb.M{"ph_number": phone})
+func (r *UserRepositoryImpl) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	id, err := r.lookupID(r.emailLookup, "email", email)
+	if err != nil {
+		return nil, err
+	}
 
-	var user models.User
-	if err := executor.GetRelease(&user); err != nil {
+	user, err := r.GetUserByID(ctx, id)
+	if err != nil {
 		return nil, err
 	}
 
-	return &user, nil
+	if user.Email != email {
+		return nil, ErrNotFound
+	}
+
+	return user, nil
 }
 
-func (r *UserRepositoryImpl) GetUserByEmailAndPhone(ctx context.Context, email, phone string) (*models.User, error) {
-	stmt, names := qb.Select(r.table.Name()).
-		Columns("email", "first_name", "last_name", "ph_number", "gender", "dob", "access").
-		Where(qb.Eq("email"), qb.Eq("ph_number")).
-		ToCql()
+func (r *UserRepositoryImpl) GetUserByPhone(ctx context.Context, phone string) (*models.User, error) {
+	id, err := r.lookupID(r.phoneLookup, "ph_number", phone)
+	if err != nil {
+		return nil, err
+	}
 
-	executor := r.session.Query(stmt, names).BindMap(qb.M{
-		"email":     email,
-		"ph_number": phone,
-	})
+	user, err := r.GetUserByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
 
-	var user models.User
-	if err := executor.GetRelease(&user); err != nil {
+	if user.PhNumber != phone {
+		return nil, ErrNotFound
+	}
+
+	return user, nil
+}
+
+func (r *UserRepositoryImpl) GetUserByEmailAndPhone(ctx context.Context, email, phone string) (*models.User, error) {
+	user, err := r.GetUserByEmail(ctx, email)
+	if err != nil {
 		return nil, err
 	}
 
-	return &user, nil
+	if user.PhNumber != phone {
+		return nil, ErrNotFound
+	}
+
+	return user, nil
 }
 
-func (r *UserRepositoryImpl) UpdateUserAccess(ctx context.Context, email string, access string) error {
+// UpdateUserAccess changes the user with an LWT and only then records the
+// change, since the history is a separate partition. A failure to record it is
+// reported with applied=true. The expiry of a time-limited block is registered
+// first, so that a block is never left without one; ListExpiredAccess drops
+// registrations the user no longer matches.
+func (r *UserRepositoryImpl) UpdateUserAccess(ctx context.Context, change *models.AccessChange, expectedVersion int64) (bool, error) {
+	if err := r.registerExpiry(change.UserID, change.ExpiresAt); err != nil {
+		return false, err
+	}
+
 	stmt, names := qb.Update(r.table.Name()).
-		Set("access").
-		Where(qb.Eq("email")).
+		Set("access", "access_expires_at", "updated_at", "updated_by", "version").
+		Where(qb.Eq("id")).
+		If(qb.EqNamed("version", "expected_version")).
 		ToCql()
 
 	executor := r.session.Query(stmt, names).BindMap(qb.M{
-		"access": access,
-		"email":  email,
+		"access":            change.Access,
+		"access_expires_at": change.ExpiresAt,
+		"updated_at":        change.ChangedAt,
+		"updated_by":        change.ChangedBy,
+		"version":           expectedVersion + 1,
+		"id":                change.UserID,
+		"expected_version":  expectedVersion,
 	})
 
-	return executor.ExecRelease()
+	applied, err := executor.ExecCASRelease()
+	if err != nil || !applied {
+		return false, scyllaError(err)
+	}
+
+	recorded := *change
+	recorded.Version = expectedVersion + 1
+
+	stmt, names = r.accessLog.Insert()
+	if err := r.session.Query(stmt, names).BindStruct(&recorded).ExecRelease(); err != nil {
+		return true, scyllaError(err)
+	}
+
+	return true, nil
 }
 
-func (r *UserRepositoryImpl) UpdateUser(ctx context.Context, user *models.User, fields []string) error {
+func (r *UserRepositoryImpl) UpdateUser(ctx context.Context, user *models.User, fields []string, modified models.Modification, expectedVersion int64) (bool, error) {
+	var previous *models.User
+	if slices.Contains(fields, "ph_number") {
+		var err error
+		if previous, err = r.GetUserByID(ctx, user.ID); err != nil {
+			return false, err
+		}
+
+		if previous.PhNumber == user.PhNumber {
+			previous = nil
+		} else {
+			claimed, err := r.claimPhone(ctx, user.PhNumber, user.ID)
+			if err != nil {
+				return false, err
+			}
+			if !claimed {
+				return false, ErrPhoneTaken
+			}
+		}
+	}
+
 	updateBuilder := qb.Update(r.table.Name())
 
 	for _, field := range fields {
@@ -114,18 +252,412 @@ func (r *UserRepositoryImpl) UpdateUser(ctx context.Context, user *models.User,
 	}
 
 	stmt, names := updateBuilder.
-		Where(qb.Eq("email")).
+		Set("updated_at", "updated_by", "version").
+		Where(qb.Eq("id")).
+		If(qb.EqNamed("version", "expected_version")).
+		ToCql()
+
+	versioned := *user
+	versioned.UpdatedAt = modified.At
+	versioned.UpdatedBy = modified.By
+	versioned.Version = expectedVersion + 1
+
+	executor := r.session.Query(stmt, names).BindStructMap(&versioned, qb.M{
+		"expected_version": expectedVersion,
+	})
+
+	applied, err := executor.ExecCASRelease()
+	if err != nil || !applied {
+		if previous != nil {
+			if releaseErr := r.clearLookup(r.phoneLookup, "ph_number", user.PhNumber, user.ID); releaseErr != nil {
+				return false, releaseErr
+			}
+		}
+		return false, scyllaError(err)
+	}
+
+	if previous != nil {
+		if err := r.clearLookup(r.phoneLookup, "ph_number", previous.PhNumber, user.ID); err != nil {
+			return true, err
+		}
+	}
+
+	return true, nil
+}
+
+// DeleteUser registers the deletion for purging before marking the user, so
+// that no deleted user is left without one; ListDeletedUsers drops
+// registrations of users that were restored in the meantime.
+func (r *UserRepositoryImpl) DeleteUser(ctx context.Context, id gocql.UUID, modified models.Modification, expectedVersion int64) (bool, error) {
+	stmt, names := r.deletions.Insert()
+	deletion := models.UserDeletion{
+		Shard:     dueTableShard(id),
+		DeletedAt: modified.At,
+		UserID:    id,
+	}
+	if err := r.session.Query(stmt, names).BindStruct(&deletion).ExecRelease(); err != nil {
+		return false, scyllaError(err)
+	}
+
+	return r.setDeleted(id, modified.At, modified.By, modified, expectedVersion)
+}
+
+// RestoreUser registers the expiry of a time-limited block again before
+// unmarking the user, since ListExpiredAccess drops it while the user is
+// deleted.
+func (r *UserRepositoryImpl) RestoreUser(ctx context.Context, id gocql.UUID, modified models.Modification, expectedVersion int64) (bool, error) {
+	user, err := r.GetUserByID(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := r.registerExpiry(id, user.AccessExpiresAt); err != nil {
+		return false, err
+	}
+
+	return r.setDeleted(id, time.Time{}, "", modified, expectedVersion)
+}
+
+func (r *UserRepositoryImpl) setDeleted(id gocql.UUID, deletedAt time.Time, deletedBy string, modified models.Modification, expectedVersion int64) (bool, error) {
+	stmt, names := qb.Update(r.table.Name()).
+		Set("deleted_at", "deleted_by", "updated_at", "updated_by", "version").
+		Where(qb.Eq("id")).
+		If(qb.EqNamed("version", "expected_version")).
 		ToCql()
 
-	executor := r.session.Query(stmt, names).BindStruct(user)
-	return executor.ExecRelease()
+	executor := r.session.Query(stmt, names).BindMap(qb.M{
+		"deleted_at":       deletedAt,
+		"deleted_by":       deletedBy,
+		"updated_at":       modified.At,
+		"updated_by":       modified.By,
+		"version":          expectedVersion + 1,
+		"id":               id,
+		"expected_version": expectedVersion,
+	})
+
+	applied, err := executor.ExecCASRelease()
+	return applied, scyllaError(err)
 }
 
-func (r *UserRepositoryImpl) DeleteUser(ctx context.Context, email string) error {
+// PurgeUser removes the user row with an LWT and then everything that points
+// to it. A failure to clean up after the row is gone is reported with
+// applied=true.
+func (r *UserRepositoryImpl) PurgeUser(ctx context.Context, id gocql.UUID, expectedVersion int64) (bool, error) {
+	user, err := r.GetUserByID(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
 	stmt, names := qb.Delete(r.table.Name()).
-		Where(qb.Eq("email")).
+		Where(qb.Eq("id")).
+		If(qb.EqNamed("version", "expected_version")).
+		ToCql()
+
+	applied, err := r.session.Query(stmt, names).BindMap(qb.M{"id": id, "expected_version": expectedVersion}).ExecCASRelease()
+	if err != nil || !applied {
+		return false, scyllaError(err)
+	}
+
+	if err := r.clearLookup(r.emailLookup, "email", user.Email, id); err != nil {
+		return true, err
+	}
+
+	if err := r.clearLookup(r.phoneLookup, "ph_number", user.PhNumber, id); err != nil {
+		return true, err
+	}
+
+	stmt, names = qb.Delete(r.accessLog.Name()).
+		Where(qb.Eq("user_id")).
+		ToCql()
+
+	if err := r.session.Query(stmt, names).BindMap(qb.M{"user_id": id}).ExecRelease(); err != nil {
+		return true, scyllaError(err)
+	}
+
+	return true, nil
+}
+
+func (r *UserRepositoryImpl) ListUsers(ctx context.Context, filter *models.UserFilter, pageSize int, pageState []byte) ([]models.User, []byte, error) {
+	var executor *gocqlx.Queryx
+
+	if filter == nil {
+		stmt, names := qb.Select(r.table.Name()).
+			Columns(models.UserMetadata.Columns...).
+			ToCql()
+
+		executor = r.session.Query(stmt, names)
+	} else {
+		// The view is partitioned by (access, gender) and clustered by dob, so
+		// restricting both partition columns with IN and dob with a range keeps
+		// the query off ALLOW FILTERING.
+		selectBuilder := qb.Select(r.filterView.Name()).
+			Columns(models.UserMetadata.Columns...).
+			Where(qb.In("access"), qb.In("gender"))
+
+		bindings := qb.M{
+			"access": filter.Access,
+			"gender": filter.Gender,
+		}
+
+		if filter.DobFrom != nil {
+			selectBuilder = selectBuilder.Where(qb.GtOrEqNamed("dob", "dob_from"))
+			bindings["dob_from"] = *filter.DobFrom
+		}
+
+		if filter.DobTo != nil {
+			selectBuilder = selectBuilder.Where(qb.LtOrEqNamed("dob", "dob_to"))
+			bindings["dob_to"] = *filter.DobTo
+		}
+
+		stmt, names := selectBuilder.ToCql()
+		executor = r.session.Query(stmt, names).BindMap(bindings)
+	}
+	defer executor.Release()
+
+	executor.PageSize(pageSize)
+	executor.PageState(pageState)
+
+	var users []models.User
+	iter := executor.Iter()
+	nextPageState := iter.PageState()
+	if err := iter.Select(&users); err != nil {
+		return nil, nil, scyllaError(err)
+	}
+
+	// Deleted users are filtered here rather than in the query, so a page may
+	// come back short while more pages follow.
+	deleted := filter != nil && filter.Deleted
+	users = slices.DeleteFunc(users, func(user models.User) bool {
+		return user.DeletedAt.IsZero() == deleted
+	})
+
+	return users, nextPageState, nil
+}
+
+func (r *UserRepositoryImpl) ListAccessChanges(ctx context.Context, userID gocql.UUID, pageSize int, pageState []byte) ([]models.AccessChange, []byte, error) {
+	stmt, names := qb.Select(r.accessLog.Name()).
+		Columns(models.AccessChangeMetadata.Columns...).
+		Where(qb.Eq("user_id")).
+		ToCql()
+
+	executor := r.session.Query(stmt, names).BindMap(qb.M{"user_id": userID})
+	defer executor.Release()
+
+	executor.PageSize(pageSize)
+	executor.PageState(pageState)
+
+	var changes []models.AccessChange
+	iter := executor.Iter()
+	nextPageState := iter.PageState()
+	if err := iter.Select(&changes); err != nil {
+		return nil, nil, scyllaError(err)
+	}
+
+	return changes, nextPageState, nil
+}
+
+// ListExpiredAccess treats the expiry of a deleted user as stale; RestoreUser
+// registers it again.
+func (r *UserRepositoryImpl) ListExpiredAccess(ctx context.Context, now time.Time, limit int) ([]models.User, error) {
+	return r.dueUsers(ctx, r.expiries, "expires_at", now, limit, func(user *models.User) time.Time {
+		if !user.DeletedAt.IsZero() {
+			return time.Time{}
+		}
+		return user.AccessExpiresAt
+	})
+}
+
+func (r *UserRepositoryImpl) ListDeletedUsers(ctx context.Context, deletedBefore time.Time, limit int) ([]models.User, error) {
+	return r.dueUsers(ctx, r.deletions, "deleted_at", deletedBefore, limit, func(user *models.User) time.Time {
+		return user.DeletedAt
+	})
+}
+
+// dueUsers reads the entries of a sharded due-time table whose column is at or
+// before now and returns the users whose current value still matches. An
+// entry whose user is gone or has since been given another value, or none, is
+// stale and deleted on the way.
+func (r *UserRepositoryImpl) dueUsers(ctx context.Context, due *table.Table, column string, now time.Time, limit int, current func(*models.User) time.Time) ([]models.User, error) {
+	type entry struct {
+		at     time.Time
+		userID gocql.UUID
+	}
+
+	var users []models.User
+
+	for shard := 0; shard < dueTableShards && len(users) < limit; shard++ {
+		stmt, names := qb.Select(due.Name()).
+			Columns(column, "user_id").
+			Where(qb.Eq("shard"), qb.LtOrEq(column)).
+			Limit(uint(limit - len(users))).
+			ToCql()
+
+		executor := r.session.Query(stmt, names).BindMap(qb.M{"shard": shard, column: now})
+
+		var entries []entry
+		var at time.Time
+		var userID gocql.UUID
+		iter := executor.Iter()
+		for iter.Scan(&at, &userID) {
+			entries = append(entries, entry{at: at, userID: userID})
+		}
+		err := iter.Close()
+		executor.Release()
+		if err != nil {
+			return nil, scyllaError(err)
+		}
+
+		for _, entry := range entries {
+			user, err := r.GetUserByID(ctx, entry.userID)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return nil, err
+			}
+
+			if err == nil && current(user).Equal(entry.at) {
+				users = append(users, *user)
+				continue
+			}
+
+			stmt, names := qb.Delete(due.Name()).
+				Where(qb.Eq("shard"), qb.Eq(column), qb.Eq("user_id")).
+				ToCql()
+
+			err = r.session.Query(stmt, names).BindMap(qb.M{"shard": shard, column: entry.at, "user_id": entry.userID}).ExecRelease()
+			if err != nil {
+				return nil, scyllaError(err)
+			}
+		}
+	}
+
+	return users, nil
+}
+
+// registerExpiry records that the block of the user ends at expiresAt, unless
+// it does not end.
+func (r *UserRepositoryImpl) registerExpiry(userID gocql.UUID, expiresAt time.Time) error {
+	if expiresAt.IsZero() {
+		return nil
+	}
+
+	stmt, names := r.expiries.Insert()
+	expiry := models.AccessExpiry{
+		Shard:     dueTableShard(userID),
+		ExpiresAt: expiresAt,
+		UserID:    userID,
+	}
+	return scyllaError(r.session.Query(stmt, names).BindStruct(&expiry).ExecRelease())
+}
+
+// dueTableShard spreads due-time entries over the shards by a hash of the
+// user id; the trailing bytes of a time UUID name the host and barely vary.
+func dueTableShard(id gocql.UUID) int {
+	hash := fnv.New32a()
+	hash.Write(id.Bytes())
+	return int(hash.Sum32() % dueTableShards)
+}
+
+func (r *UserRepositoryImpl) claimEmail(ctx context.Context, email string, id gocql.UUID) (bool, error) {
+	return r.claimLookup(ctx, r.emailLookup, "email", email, id, func(owner *models.User) string {
+		return owner.Email
+	})
+}
+
+func (r *UserRepositoryImpl) claimPhone(ctx context.Context, phone string, id gocql.UUID) (bool, error) {
+	return r.claimLookup(ctx, r.phoneLookup, "ph_number", phone, id, func(owner *models.User) string {
+		return owner.PhNumber
+	})
+}
+
+// claimLookup registers value for id with an LWT, which is what makes emails
+// and phone numbers unique. An existing registration only blocks the claim
+// while the user it points to still has that value, or while it is younger
+// than lookupClaimGrace: a claim is written before the user row it belongs to,
+// so a fresh one may be a write still in flight. Older registrations that no
+// user confirms were left behind by an interrupted write and are taken over.
+func (r *UserRepositoryImpl) claimLookup(ctx context.Context, lookup *table.Table, column, value string, id gocql.UUID, current func(*models.User) string) (bool, error) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	stmt, names := qb.Insert(lookup.Name()).
+		Columns(column, "id", "claimed_at").
+		Unique().
+		ToCql()
+
+	applied, err := r.session.Query(stmt, names).BindMap(qb.M{column: value, "id": id, "claimed_at": now}).ExecCASRelease()
+	if err != nil || applied {
+		return applied, scyllaError(err)
+	}
+
+	stmt, names = qb.Select(lookup.Name()).
+		Columns("id", "claimed_at").
+		Where(qb.Eq(column)).
+		ToCql()
+
+	var claim struct {
+		ID        gocql.UUID `db:"id"`
+		ClaimedAt time.Time  `db:"claimed_at"`
+	}
+	if err := r.session.Query(stmt, names).BindMap(qb.M{column: value}).GetRelease(&claim); err != nil {
+		return false, scyllaError(err)
+	}
+
+	if claim.ID == id {
+		return true, nil
+	}
+
+	owner, err := r.GetUserByID(ctx, claim.ID)
+	if err == nil && current(owner) == value {
+		return false, nil
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+
+	// Registrations from before claimed_at was recorded read as the zero
+	// time and can be taken over straight away.
+	if now.Sub(claim.ClaimedAt) < lookupClaimGrace {
+		return false, nil
+	}
+
+	stmt, names = qb.Update(lookup.Name()).
+		Set("id", "claimed_at").
+		Where(qb.Eq(column)).
+		If(qb.EqNamed("id", "owner_id")).
+		ToCql()
+
+	applied, err = r.session.Query(stmt, names).BindMap(qb.M{
+		"id":         id,
+		"claimed_at": now,
+		column:       value,
+		"owner_id":   claim.ID,
+	}).ExecCASRelease()
+	return applied, scyllaError(err)
+}
+
+func (r *UserRepositoryImpl) lookupID(lookup *table.Table, column, value string) (gocql.UUID, error) {
+	stmt, names := qb.Select(lookup.Name()).
+		Columns("id").
+		Where(qb.Eq(column)).
+		ToCql()
+
+	var id gocql.UUID
+	err := r.session.Query(stmt, names).BindMap(qb.M{column: value}).GetRelease(&id)
+	return id, scyllaError(err)
+}
+
+// clearLookup removes a lookup entry only while it still points to id, so a
+// value that has since been claimed by another user is left alone.
+func (r *UserRepositoryImpl) clearLookup(lookup *table.Table, column, value string, id gocql.UUID) error {
+	stmt, names := qb.Delete(lookup.Name()).
+		Where(qb.Eq(column)).
+		If(qb.EqNamed("id", "owner_id")).
 		ToCql()
 
-	executor := r.session.Query(stmt, names).BindMap(qb.M{"email": email})
-	return executor.ExecRelease()
+	_, err := r.session.Query(stmt, names).BindMap(qb.M{column: value, "owner_id": id}).ExecCASRelease()
+	return scyllaError(err)
 }
@@ -0,0 +1,48 @@
+package repositories_test
+
+import (
+	"os"
+	"testing"
+
+	"2k4sm/grpc-crud/src/db"
+	"2k4sm/grpc-crud/src/repositories"
+	"2k4sm/grpc-crud/src/repositories/repositorytest"
+)
+
+// scyllaTables are emptied before every subtest; the materialized view
+// follows its base table.
+var scyllaTables = []string{
+	"users_by_id",
+	"users_by_email",
+	"users_by_phone",
+	"user_email_changes",
+	"user_access_changes",
+	"access_expiries",
+	"deleted_users",
+}
+
+// TestScyllaUserRepository runs against the cluster named by SDB_URI and
+// empties the catalog keyspace, so it must not point at one holding real
+// users. Without SDB_URI it is skipped, or fails when built with the scylla
+// tag.
+func TestScyllaUserRepository(t *testing.T) {
+	if os.Getenv("SDB_URI") == "" {
+		if scyllaRequired {
+			t.Fatal("SDB_URI is not set, the scylla tag requires a ScyllaDB cluster")
+		}
+		t.Skip("SDB_URI is not set, set it and build with the scylla tag to cover ScyllaDB")
+	}
+
+	session := db.InitDb()
+	defer session.Close()
+
+	repositorytest.Run(t, func(t *testing.T) repositories.UserRepository {
+		for _, table := range scyllaTables {
+			if err := session.ExecStmt("TRUNCATE catalog." + table); err != nil {
+				t.Fatalf("Truncating %s: %v", table, err)
+			}
+		}
+
+		return repositories.NewUserRepository(session)
+	})
+}
@@ -0,0 +1,52 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	userspb "2k4sm/grpc-crud/proto/users"
+	"2k4sm/grpc-crud/src/models"
+)
+
+const (
+	// accessExpiryActor is recorded as the one who lifted an expired block.
+	accessExpiryActor     = "access-expiry"
+	accessExpiryBatchSize = 100
+)
+
+// RunAccessExpiry lifts expired blocks every interval until ctx is done.
+func (us *UserService) RunAccessExpiry(ctx context.Context, interval time.Duration) {
+	runEvery(ctx, interval, us.LiftExpiredAccess, "Failed to lift expired blocks:", "Lifted %d expired blocks")
+}
+
+// LiftExpiredAccess unblocks every user whose block has ended, with the same
+// effects as UnblockUser, and returns how many it unblocked.
+func (us *UserService) LiftExpiredAccess(ctx context.Context) (int, error) {
+	return processDue(ctx, accessExpiryBatchSize, func(ctx context.Context, limit int) ([]models.User, error) {
+		return us.userRepo.ListExpiredAccess(ctx, us.now(), limit)
+	}, us.liftAccess)
+}
+
+// liftAccess unblocks user and reports whether it did.
+func (us *UserService) liftAccess(ctx context.Context, user *models.User) bool {
+	change := &models.AccessChange{
+		Access: "UNBLOCKED",
+		Reason: "Block expired at " + user.AccessExpiresAt.Format(time.RFC3339),
+	}
+	modified := models.Modification{At: us.now().UTC().Truncate(time.Millisecond), By: accessExpiryActor}
+
+	defer us.writes.lock(user.ID)()
+
+	applied, err := us.applyAccessChange(ctx, user, user.Version, change, modified)
+	if err != nil {
+		log.Printf("Failed to lift expired block of user %s: %v", user.ID, err)
+		return false
+	}
+	if !applied {
+		return false
+	}
+
+	us.announce(userspb.UserEventType_USER_UNBLOCKED, user)
+	return true
+}
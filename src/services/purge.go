@@ -0,0 +1,34 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"2k4sm/grpc-crud/src/models"
+)
+
+const purgeBatchSize = 100
+
+// RunPurge permanently removes users deleted longer than the retention ago
+// every interval until ctx is done.
+func (us *UserService) RunPurge(ctx context.Context, interval time.Duration) {
+	runEvery(ctx, interval, us.PurgeDeletedUsers, "Failed to purge deleted users:", "Purged %d deleted users")
+}
+
+// PurgeDeletedUsers removes every user whose retention has passed and returns
+// how many it removed. A user restored since it was listed is kept.
+func (us *UserService) PurgeDeletedUsers(ctx context.Context) (int, error) {
+	return processDue(ctx, purgeBatchSize, func(ctx context.Context, limit int) ([]models.User, error) {
+		return us.userRepo.ListDeletedUsers(ctx, us.now().Add(-us.retention), limit)
+	}, us.purgeUser)
+}
+
+func (us *UserService) purgeUser(ctx context.Context, user *models.User) bool {
+	applied, err := us.userRepo.PurgeUser(ctx, user.ID, user.Version)
+	if err != nil {
+		log.Printf("Failed to purge user %s: %v", user.ID, err)
+		return false
+	}
+	return applied
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"2k4sm/grpc-crud/src/models"
+)
+
+// runEvery runs job right away and then every interval until ctx is done,
+// logging how many users it handled with done, a format taking the count.
+func runEvery(ctx context.Context, interval time.Duration, job func(ctx context.Context) (int, error), failure, done string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		handled, err := job(ctx)
+		if err != nil {
+			log.Println(failure, err)
+		}
+		if handled > 0 {
+			log.Printf(done, handled)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// processDue lists users that are due batchSize at a time and hands each to
+// process until none are left, returning how many process reported handled.
+//
+// The background jobs built on it run on every replica of the server. That is
+// safe as long as process only makes writes conditioned on the version the
+// user was listed at: when replicas race, or a request changes the user in
+// the meantime, all but one write fail and the user is left alone. A batch in
+// which nothing could be handled ends the run, since it would only be listed
+// again.
+func processDue(ctx context.Context, batchSize int, list func(ctx context.Context, limit int) ([]models.User, error), process func(ctx context.Context, user *models.User) bool) (int, error) {
+	total := 0
+	for {
+		users, err := list(ctx, batchSize)
+		if err != nil {
+			return total, err
+		}
+
+		handled := 0
+		for i := range users {
+			if process(ctx, &users[i]) {
+				handled++
+			}
+		}
+		total += handled
+
+		if len(users) < batchSize || handled == 0 {
+			return total, nil
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package services
+
+import (
+	"sync"
+
+	"github.com/gocql/gocql"
+)
+
+// userLocks serializes the writes to a user together with the events that
+// announce them, so that the events of a user are published in the order its
+// writes were applied. Writes are conditioned on the version they read, so
+// holding the lock from the write until the event is published is enough. It
+// only orders the writes of this process, which are the only ones its broker
+// publishes.
+type userLocks struct {
+	mu    sync.Mutex
+	locks map[gocql.UUID]*userLock
+}
+
+type userLock struct {
+	mu sync.Mutex
+	// holders counts who holds or waits for mu, so that the lock of a user
+	// nobody is writing can be dropped.
+	holders int
+}
+
+// lock locks the user with id and returns the function unlocking it.
+func (l *userLocks) lock(id gocql.UUID) (unlock func()) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[gocql.UUID]*userLock)
+	}
+	lock, ok := l.locks[id]
+	if !ok {
+		lock = &userLock{}
+		l.locks[id] = lock
+	}
+	lock.holders++
+	l.mu.Unlock()
+
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if lock.holders--; lock.holders == 0 {
+			delete(l.locks, id)
+		}
+	}
+}
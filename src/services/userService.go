@@ -2,306 +2,1038 @@ package services
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	userspb "2k4sm/grpc-crud/proto/users"
+	"2k4sm/grpc-crud/src/convert"
+	"2k4sm/grpc-crud/src/email"
+	"2k4sm/grpc-crud/src/events"
 	"2k4sm/grpc-crud/src/models"
+	"2k4sm/grpc-crud/src/phone"
 	"2k4sm/grpc-crud/src/repositories"
 
+	"github.com/gocql/gocql"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultPageSize    = 50
+	maxPageSize        = 500
+	eventHistorySize   = 1024
+	watcherChannelSize = 64
+	batchConcurrency   = 16
+	storageRetryDelay  = time.Second
+	actorMetadataKey   = "x-actor"
+	anonymousActor     = "anonymous"
 )
 
 type UserService struct {
 	userRepo repositories.UserRepository
+	events   *events.Broker
+	phones   *phone.Normalizer
+	emails   *email.Canonicalizer
+	// retention is how long a deleted user can be restored before it is
+	// purged.
+	retention time.Duration
+	// now is the clock the service reads the current time from.
+	now func() time.Time
+	// writes orders the events of each user; see userLocks.
+	writes userLocks
 	userspb.UnimplementedUsersServer
 }
 
-func NewUserService(userRepo repositories.UserRepository) *UserService {
+func NewUserService(userRepo repositories.UserRepository, phones *phone.Normalizer, emails *email.Canonicalizer, retention time.Duration) *UserService {
 	return &UserService{
-		userRepo: userRepo,
+		userRepo:  userRepo,
+		events:    events.NewBroker(eventHistorySize),
+		phones:    phones,
+		emails:    emails,
+		retention: retention,
+		now:       time.Now,
 	}
 }
 
 func (us *UserService) CreateUser(ctx context.Context, req *userspb.UserRequest) (*userspb.UserResponse, error) {
-	if req.Email == "" || req.FirstName == "" || req.LastName == "" || req.PhNumber == "" || req.Dob == "" {
-		return nil, status.Error(codes.InvalidArgument, "Invalid Input: email, first_name, last_name and ph_number are required")
+	var violations badRequest
+	parsedDate := violations.dateOfBirth("", req.GetBirthDate(), req.GetDob())
+	phNumber := violations.phone(us.phones, "ph_number", req.GetPhNumber())
+	canonicalEmail := violations.email(us.emails, "email", req.GetEmail())
+	gender := violations.optionalGender("gender", req.Gender)
+	if access := req.GetAccess(); req.Access != nil && access != userspb.Access_ACCESS_UNSPECIFIED && access != userspb.Access_UNBLOCKED {
+		violations.add("access", "must be UNBLOCKED, other states are set with BlockUser")
 	}
-
-	dateString := req.GetDob()
-	parsedDate, err := time.Parse("2006-01-02", dateString)
-	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to parse date string: %v", err))
+	if err := violations.err(); err != nil {
+		return nil, err
 	}
 
+	modified := us.modification(ctx)
 	newUser := &models.User{
-		Email:     req.GetEmail(),
-		FirstName: req.GetFirstName(),
-		PhNumber:  req.GetPhNumber(),
-		LastName:  req.GetLastName(),
-		Gender:    req.GetGender().String(),
-		Dob:       parsedDate,
-		Access:    req.GetAccess().String(),
+		ID:           gocql.TimeUUID(),
+		Email:        canonicalEmail,
+		DisplayEmail: email.Display(req.GetEmail()),
+		FirstName:    req.GetFirstName(),
+		PhNumber:     phNumber,
+		LastName:     req.GetLastName(),
+		Gender:       gender,
+		Dob:          parsedDate,
+		Access:       "UNBLOCKED",
+		Version:      1,
+		CreatedAt:    modified.At,
+		UpdatedAt:    modified.At,
+		CreatedBy:    modified.By,
+		UpdatedBy:    modified.By,
 	}
 
+	defer us.writes.lock(newUser.ID)()
 	created, err := us.userRepo.CreateUser(ctx, newUser)
+	if errors.Is(err, repositories.ErrPhoneTaken) {
+		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("User Already Exists with ph_number: %s", phNumber))
+	}
 	if err != nil {
-		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("Error creating user: %v", err))
+		return nil, repositoryError(err, "Error creating user")
 	}
 
 	if !created {
-		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("User Already Exists with email id: %s", req.GetEmail()))
+		// A deleted user keeps its email until it is purged.
+		if existing, err := us.userRepo.GetUserByEmail(ctx, canonicalEmail); err == nil && !existing.DeletedAt.IsZero() {
+			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("User with email id %s was deleted and can be restored until %s",
+				canonicalEmail, existing.DeletedAt.Add(us.retention).Format(time.RFC3339)))
+		}
+		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("User Already Exists with email id: %s", canonicalEmail))
 	}
 
 	log.Println("User Created Successfully")
 
-	return &userspb.UserResponse{
-		Email:     newUser.Email,
-		PhNumber:  newUser.PhNumber,
-		FirstName: newUser.FirstName,
-		LastName:  newUser.LastName,
-		Gender:    models.GenderStrToGender(newUser.Gender),
-		Dob:       parsedDate.Format(time.RFC3339),
-		Access:    models.AccessStrToAccess(newUser.Access),
-	}, nil
+	res, err := userResponse(newUser)
+	if err != nil {
+		return nil, err
+	}
+
+	us.events.Publish(userspb.UserEventType_USER_CREATED, res, "")
+	return res, nil
 }
 
 func (us *UserService) GetUser(ctx context.Context, req *userspb.GetUserRequest) (*userspb.UserResponse, error) {
-	if req.Email == nil && req.PhNumber == nil {
-		return nil, status.Error(codes.InvalidArgument, "Invalid Input: email or ph_number required")
+	var violations badRequest
+	var phNumber, canonicalEmail string
+	if req.PhNumber != nil {
+		phNumber = violations.phone(us.phones, "ph_number", req.GetPhNumber())
+	}
+	if req.Email != nil {
+		canonicalEmail = violations.email(us.emails, "email", req.GetEmail())
+	}
+	if err := violations.err(); err != nil {
+		return nil, err
 	}
 
 	var user *models.User
 	var err error
 
 	if req.Email != nil && req.PhNumber != nil {
-		user, err = us.userRepo.GetUserByEmailAndPhone(ctx, *req.Email, *req.PhNumber)
+		user, err = us.userRepo.GetUserByEmailAndPhone(ctx, canonicalEmail, phNumber)
 	} else if req.Email != nil {
-		user, err = us.userRepo.GetUserByEmail(ctx, *req.Email)
+		user, err = us.userRepo.GetUserByEmail(ctx, canonicalEmail)
 	} else if req.PhNumber != nil {
-		user, err = us.userRepo.GetUserByPhone(ctx, *req.PhNumber)
+		user, err = us.userRepo.GetUserByPhone(ctx, phNumber)
 	}
 
 	if err != nil {
-		return nil, status.Error(codes.NotFound, fmt.Sprintf("User Not Found: %v", err))
+		return nil, repositoryError(err, "Error retrieving user")
+	}
+
+	if err := tombstoned(user); err != nil {
+		return nil, err
 	}
 
-	if user.Access == "BLOCKED" {
-		return nil, status.Error(codes.PermissionDenied, "User Access Blocked")
+	if err := us.accessDenied(user); err != nil {
+		return nil, err
 	}
 
 	log.Println("User Found Successfully")
-	return &userspb.UserResponse{
-		Email:     user.Email,
-		FirstName: user.FirstName,
-		LastName:  user.LastName,
-		PhNumber:  user.PhNumber,
-		Gender:    models.GenderStrToGender(user.Gender),
-		Dob:       user.Dob.Format(time.RFC3339),
-		Access:    models.AccessStrToAccess(user.Access),
-	}, nil
+	return userResponse(user)
 }
 
-func (us *UserService) BlockUser(ctx context.Context, req *userspb.UserAccessUpdateRequest) (*userspb.UserResponse, error) {
-	if req.Email == "" {
-		return nil, status.Error(codes.InvalidArgument, "Invalid Input: email required")
+func (us *UserService) GetUserById(ctx context.Context, req *userspb.GetUserByIdRequest) (*userspb.UserResponse, error) {
+	id, err := gocql.ParseUUID(req.GetId())
+	if err != nil {
+		return nil, invalidField("id", fmt.Sprintf("is not a valid id: %v", err))
 	}
 
-	user, err := us.userRepo.GetUserByEmail(ctx, req.Email)
+	user, err := us.userRepo.GetUserByID(ctx, id)
 	if err != nil {
-		return nil, status.Error(codes.NotFound, fmt.Sprintf("User not found: %v", err))
+		return nil, repositoryError(err, "Error retrieving user")
 	}
 
-	err = us.userRepo.UpdateUserAccess(ctx, req.Email, "BLOCKED")
-	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("Error blocking user: %v", err))
+	if err := tombstoned(user); err != nil {
+		return nil, err
+	}
+
+	if err := us.accessDenied(user); err != nil {
+		return nil, err
 	}
 
-	user.Access = "BLOCKED"
+	log.Println("User Found Successfully")
+	return userResponse(user)
+}
 
-	return &userspb.UserResponse{
-		Email:     user.Email,
-		FirstName: user.FirstName,
-		LastName:  user.LastName,
-		PhNumber:  user.PhNumber,
-		Gender:    models.GenderStrToGender(user.Gender),
-		Dob:       user.Dob.Format(time.RFC3339),
-		Access:    models.AccessStrToAccess(user.Access),
-	}, nil
+func (us *UserService) BlockUser(ctx context.Context, req *userspb.BlockUserRequest) (*userspb.UserResponse, error) {
+	var violations badRequest
+	canonicalEmail := violations.email(us.emails, "email", req.GetEmail())
+	if strings.TrimSpace(req.GetReason()) == "" {
+		violations.add("reason", "must not be blank")
+	}
+	access, expiresAt := violations.restriction(req.GetAccess(), req.GetUntil(), us.now())
+	if err := violations.err(); err != nil {
+		return nil, err
+	}
+
+	return us.changeAccess(ctx, canonicalEmail, req.ExpectedVersion, &models.AccessChange{
+		Access:    access,
+		Reason:    strings.TrimSpace(req.GetReason()),
+		ExpiresAt: expiresAt,
+	}, userspb.UserEventType_USER_BLOCKED, "Error blocking user")
 }
 
 func (us *UserService) UnblockUser(ctx context.Context, req *userspb.UserAccessUpdateRequest) (*userspb.UserResponse, error) {
-	if req.Email == "" {
-		return nil, status.Error(codes.InvalidArgument, "Invalid Input: email required")
+	canonicalEmail, err := us.canonicalEmail("email", req.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	return us.changeAccess(ctx, canonicalEmail, req.ExpectedVersion, &models.AccessChange{
+		Access: "UNBLOCKED",
+		Reason: strings.TrimSpace(req.GetReason()),
+	}, userspb.UserEventType_USER_UNBLOCKED, "Error unblocking user")
+}
+
+// changeAccess moves the user with canonicalEmail to the access state of
+// change, records change in the user's access history and announces it as
+// eventType.
+func (us *UserService) changeAccess(ctx context.Context, canonicalEmail string, requestedVersion *int64, change *models.AccessChange, eventType userspb.UserEventType, failure string) (*userspb.UserResponse, error) {
+	user, err := us.userRepo.GetUserByEmail(ctx, canonicalEmail)
+	if err != nil {
+		return nil, repositoryError(err, "Error retrieving user")
 	}
 
-	user, err := us.userRepo.GetUserByEmail(ctx, req.Email)
+	if err := tombstoned(user); err != nil {
+		return nil, err
+	}
+
+	expectedVersion, err := resolveExpectedVersion(ctx, requestedVersion, user.Version)
 	if err != nil {
-		return nil, status.Error(codes.NotFound, fmt.Sprintf("User not found: %v", err))
+		return nil, err
 	}
 
-	err = us.userRepo.UpdateUserAccess(ctx, req.Email, "UNBLOCKED")
+	defer us.writes.lock(user.ID)()
+	applied, err := us.applyAccessChange(ctx, user, expectedVersion, change, us.modification(ctx))
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("Error unblocking user: %v", err))
+		return nil, repositoryError(err, failure)
 	}
 
-	user.Access = "UNBLOCKED"
+	if !applied {
+		return nil, versionConflict(canonicalEmail)
+	}
 
-	return &userspb.UserResponse{
-		Email:     user.Email,
-		FirstName: user.FirstName,
-		LastName:  user.LastName,
-		PhNumber:  user.PhNumber,
-		Gender:    models.GenderStrToGender(user.Gender),
-		Dob:       user.Dob.Format(time.RFC3339),
-		Access:    models.AccessStrToAccess(user.Access),
-	}, nil
+	res, err := userResponse(user)
+	if err != nil {
+		return nil, err
+	}
+
+	us.events.Publish(eventType, res, "")
+	return res, nil
 }
 
-func (us *UserService) UpdateUser(ctx context.Context, req *userspb.UserRequest) (*userspb.UserResponse, error) {
-	if req.Email == "" {
-		return nil, status.Error(codes.InvalidArgument, "Invalid Input: email is required")
+// applyAccessChange fills in the user, previous state and modification of
+// change and writes it if user is still at expectedVersion. An applied change
+// is also applied to user.
+func (us *UserService) applyAccessChange(ctx context.Context, user *models.User, expectedVersion int64, change *models.AccessChange, modified models.Modification) (bool, error) {
+	change.UserID = user.ID
+	change.PreviousAccess = user.Access
+	change.ChangedAt = modified.At
+	change.ChangedBy = modified.By
+
+	applied, err := us.userRepo.UpdateUserAccess(ctx, change, expectedVersion)
+	if err != nil || !applied {
+		return applied, err
 	}
 
-	existingUser, err := us.userRepo.GetUserByEmail(ctx, req.Email)
+	user.Access = change.Access
+	user.AccessExpiresAt = change.ExpiresAt
+	user.UpdatedAt = modified.At
+	user.UpdatedBy = modified.By
+	user.Version = expectedVersion + 1
+	return true, nil
+}
+
+func (us *UserService) GetAccessHistory(ctx context.Context, req *userspb.GetAccessHistoryRequest) (*userspb.GetAccessHistoryResponse, error) {
+	canonicalEmail, err := us.canonicalEmail("email", req.GetEmail())
 	if err != nil {
-		return nil, status.Error(codes.NotFound, fmt.Sprintf("User not found: %v", err))
+		return nil, err
 	}
 
-	if existingUser.Access == "BLOCKED" {
-		return nil, status.Error(codes.PermissionDenied, "User Access Blocked")
+	pageSize, err := clampPageSize(req.GetPageSize())
+	if err != nil {
+		return nil, err
 	}
 
-	updatedUser := &models.User{
-		Email: req.GetEmail(),
+	pageState, err := base64.RawURLEncoding.DecodeString(req.GetPageToken())
+	if err != nil {
+		return nil, invalidField("page_token", "is malformed")
 	}
 
-	fieldsToUpdate := []string{}
+	user, err := us.userRepo.GetUserByEmail(ctx, canonicalEmail)
+	if err != nil {
+		return nil, repositoryError(err, "Error retrieving user")
+	}
 
-	if req.FirstName != "" {
-		updatedUser.FirstName = req.GetFirstName()
-		fieldsToUpdate = append(fieldsToUpdate, "first_name")
+	if err := tombstoned(user); err != nil {
+		return nil, err
 	}
 
-	if req.LastName != "" {
-		updatedUser.LastName = req.GetLastName()
-		fieldsToUpdate = append(fieldsToUpdate, "last_name")
+	changes, nextPageState, err := us.userRepo.ListAccessChanges(ctx, user.ID, pageSize, pageState)
+	if errors.Is(err, repositories.ErrInvalidPageState) {
+		return nil, invalidField("page_token", "is malformed")
+	}
+	if err != nil {
+		return nil, repositoryError(err, "Error retrieving access history")
 	}
 
-	if req.PhNumber != "" {
-		updatedUser.PhNumber = req.GetPhNumber()
-		fieldsToUpdate = append(fieldsToUpdate, "ph_number")
+	res := &userspb.GetAccessHistoryResponse{
+		Changes:       make([]*userspb.AccessChange, 0, len(changes)),
+		NextPageToken: base64.RawURLEncoding.EncodeToString(nextPageState),
 	}
 
-	if req.Gender.String() != "" {
-		updatedUser.Gender = req.GetGender().String()
-		fieldsToUpdate = append(fieldsToUpdate, "gender")
+	for _, change := range changes {
+		changeRes, err := convert.AccessChangeToProto(&change)
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Stored access change %d of user %s is invalid: %v", change.Version, user.ID, err))
+		}
+		res.Changes = append(res.Changes, changeRes)
 	}
 
-	if req.Dob != "" {
-		parsedDate, err := time.Parse("2006-01-02", req.Dob)
-		if err == nil {
-			updatedUser.Dob = parsedDate
-			fieldsToUpdate = append(fieldsToUpdate, "dob")
+	log.Println("Access history retrieved successfully")
+	return res, nil
+}
+
+func (us *UserService) UpdateUser(ctx context.Context, req *userspb.UpdateUserRequest) (*userspb.UserResponse, error) {
+	canonicalEmail, err := us.canonicalEmail("email", req.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	existingUser, err := us.userRepo.GetUserByEmail(ctx, canonicalEmail)
+	if err != nil {
+		return nil, repositoryError(err, "Error retrieving user")
+	}
+
+	if err := tombstoned(existingUser); err != nil {
+		return nil, err
+	}
+
+	if err := us.accessDenied(existingUser); err != nil {
+		return nil, err
+	}
+
+	paths := req.GetUpdateMask().GetPaths()
+	if len(paths) == 0 {
+		paths = presentUserFields(req.GetUser())
+	}
+
+	updatedUser := &models.User{
+		ID:    existingUser.ID,
+		Email: canonicalEmail,
+	}
+
+	fieldsToUpdate := []string{}
+	seen := map[string]bool{}
+	var violations badRequest
+
+	for _, path := range paths {
+		// birth_date and the legacy dob name the same stored field. Masks the
+		// gateway derives from PATCH bodies list the parts of the date.
+		field := path
+		if field == "birth_date" || strings.HasPrefix(field, "birth_date.") {
+			field = "dob"
 		}
+
+		if seen[field] {
+			continue
+		}
+		seen[field] = true
+
+		switch field {
+		case "first_name":
+			updatedUser.FirstName = req.GetUser().GetFirstName()
+		case "last_name":
+			updatedUser.LastName = req.GetUser().GetLastName()
+		case "ph_number":
+			if req.GetUser().GetPhNumber() == "" {
+				violations.add("user.ph_number", "cannot be cleared")
+			} else {
+				updatedUser.PhNumber = violations.phone(us.phones, "user.ph_number", req.GetUser().GetPhNumber())
+			}
+		case "gender":
+			updatedUser.Gender = violations.optionalGender("user.gender", req.GetUser().Gender)
+		case "dob":
+			if req.GetUser().GetBirthDate() == nil && req.GetUser().GetDob() == "" {
+				violations.add("user."+path, "cannot be cleared")
+			} else {
+				updatedUser.Dob = violations.dateOfBirth("user.", req.GetUser().GetBirthDate(), req.GetUser().GetDob())
+			}
+		case "access":
+			violations.add("update_mask", `field "access" is changed with BlockUser and UnblockUser`)
+			continue
+		default:
+			violations.add("update_mask", fmt.Sprintf("field %q cannot be updated", path))
+			continue
+		}
+
+		fieldsToUpdate = append(fieldsToUpdate, field)
 	}
 
-	if req.Access.String() != "" {
-		updatedUser.Access = req.GetAccess().String()
-		fieldsToUpdate = append(fieldsToUpdate, "access")
+	if err := violations.err(); err != nil {
+		return nil, err
 	}
 
 	if len(fieldsToUpdate) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "No fields to update")
+		return nil, invalidField("update_mask", "names no fields to update")
 	}
 
-	err = us.userRepo.UpdateUser(ctx, updatedUser, fieldsToUpdate)
+	expectedVersion, err := resolveExpectedVersion(ctx, req.ExpectedVersion, existingUser.Version)
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("Error updating user: %v", err))
+		return nil, err
+	}
+
+	defer us.writes.lock(existingUser.ID)()
+	applied, err := us.userRepo.UpdateUser(ctx, updatedUser, fieldsToUpdate, us.modification(ctx), expectedVersion)
+	if errors.Is(err, repositories.ErrPhoneTaken) {
+		return nil, status.Error(codes.AlreadyExists, "User with phone number already exists")
+	}
+	if err != nil {
+		return nil, repositoryError(err, "Error updating user")
+	}
+
+	if !applied {
+		return nil, versionConflict(canonicalEmail)
 	}
 
-	updatedUserData, err := us.userRepo.GetUserByEmail(ctx, req.Email)
+	updatedUserData, err := us.userRepo.GetUserByID(ctx, existingUser.ID)
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("Error retrieving updated user: %v", err))
+		return nil, repositoryError(err, "Error retrieving updated user")
 	}
 
 	log.Println("User updated successfully")
-	return &userspb.UserResponse{
-		Email:     updatedUserData.Email,
-		FirstName: updatedUserData.FirstName,
-		LastName:  updatedUserData.LastName,
-		PhNumber:  updatedUserData.PhNumber,
-		Gender:    models.GenderStrToGender(updatedUserData.Gender),
-		Dob:       updatedUserData.Dob.Format(time.RFC3339),
-		Access:    models.AccessStrToAccess(updatedUserData.Access),
-	}, nil
+	res, err := userResponse(updatedUserData)
+	if err != nil {
+		return nil, err
+	}
+
+	us.events.Publish(userspb.UserEventType_USER_UPDATED, res, "")
+	return res, nil
 }
 
-func (us *UserService) UpdatePhoneOrEmail(ctx context.Context, req *userspb.UpdatePhoneOrEmailRequest) (*userspb.UserResponse, error) {
-	if req.GetCurrEmail() == "" {
-		return nil, status.Error(codes.InvalidArgument, "Current email is required")
+// resolveExpectedVersion returns the version a write must be conditioned on:
+// the one the client asked for, either in the request or as an If-Match
+// header forwarded by the gateway, or otherwise the version that was just read.
+func resolveExpectedVersion(ctx context.Context, requested *int64, current int64) (int64, error) {
+	if requested == nil {
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get("if-match"); len(values) > 0 {
+				etag := strings.Trim(strings.TrimPrefix(values[0], "W/"), `"`)
+				version, err := strconv.ParseInt(etag, 10, 64)
+				if err != nil {
+					return 0, invalidField("expected_version", fmt.Sprintf("If-Match header is not a version: %v", err))
+				}
+				requested = &version
+			}
+		}
+	}
+
+	if requested == nil {
+		return current, nil
 	}
 
-	if req.GetNewEmail() == "" && req.GetNewPhNumber() == "" {
-		return nil, status.Error(codes.InvalidArgument, "Either new email or new phone number must be provided")
+	if *requested != current {
+		return 0, status.Error(codes.FailedPrecondition, fmt.Sprintf("Version mismatch: expected %d, current %d", *requested, current))
+	}
+
+	return *requested, nil
+}
+
+// modification stamps a write with the current time and the caller named by
+// the x-actor metadata, which the gateway fills from the X-Actor header.
+func (us *UserService) modification(ctx context.Context) models.Modification {
+	by := anonymousActor
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(actorMetadataKey); len(values) > 0 && values[0] != "" {
+			by = values[0]
+		}
+	}
+
+	// Stored timestamps keep milliseconds, so responses are rounded to match.
+	return models.Modification{At: us.now().UTC().Truncate(time.Millisecond), By: by}
+}
+
+// userResponse converts a stored user for a response. Stored data the API
+// cannot represent, such as an unknown gender, is reported instead of being
+// replaced by a default.
+func userResponse(user *models.User) (*userspb.UserResponse, error) {
+	res, err := convert.UserToProto(user)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Stored user %s is invalid: %v", user.ID, err))
+	}
+	return res, nil
+}
+
+// announce publishes an event for a write that has already been applied. A
+// user that cannot be represented is logged and not announced rather than
+// failing the write after the fact.
+func (us *UserService) announce(eventType userspb.UserEventType, user *models.User) {
+	res, err := convert.UserToProto(user)
+	if err != nil {
+		log.Printf("Not publishing %s of user %s: %v", eventType, user.ID, err)
+		return
+	}
+	us.events.Publish(eventType, res, "")
+}
+
+// canonicalEmail canonicalizes the email a request names a user by.
+func (us *UserService) canonicalEmail(field, value string) (string, error) {
+	var violations badRequest
+	canonical := violations.email(us.emails, field, value)
+	return canonical, violations.err()
+}
+
+// tombstoned returns NotFound for a deleted user, which is hidden like a
+// missing one from everything but ListUsers and RestoreUser.
+func tombstoned(user *models.User) error {
+	if user.DeletedAt.IsZero() {
+		return nil
+	}
+	return status.Error(codes.NotFound, fmt.Sprintf("User not found: %s was deleted", user.Email))
+}
+
+// accessDenied returns the error for a user that may not be read or changed,
+// or nil for an UNBLOCKED user and one whose block has ended but was not
+// lifted yet.
+func (us *UserService) accessDenied(user *models.User) error {
+	if !user.AccessExpiresAt.IsZero() && !us.now().Before(user.AccessExpiresAt) {
+		return nil
+	}
+
+	switch user.Access {
+	case "UNBLOCKED":
+		return nil
+	case "SUSPENDED":
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("User Access Suspended until %s", user.AccessExpiresAt.Format(time.RFC3339)))
+	case "BLOCKED":
+		return status.Error(codes.PermissionDenied, "User Access Blocked")
+	case "LOCKED":
+		return status.Error(codes.PermissionDenied, "User Access Locked")
+	case "DEACTIVATED":
+		return status.Error(codes.PermissionDenied, "User Access Deactivated")
+	}
+	return status.Error(codes.PermissionDenied, fmt.Sprintf("User Access %s", user.Access))
+}
+
+func versionConflict(email string) error {
+	return status.Error(codes.FailedPrecondition, fmt.Sprintf("User %s was modified concurrently, reload and retry", email))
+}
+
+// repositoryError maps a repository failure to a gRPC status. Timeouts and
+// outages are transient, so they carry a RetryInfo detail telling clients
+// when to try again; anything unclassified is an internal error.
+func repositoryError(err error, message string) error {
+	var code codes.Code
+	switch {
+	case errors.Is(err, repositories.ErrNotFound):
+		return status.Error(codes.NotFound, fmt.Sprintf("User not found: %v", err))
+	case errors.Is(err, repositories.ErrConflict):
+		return status.Error(codes.AlreadyExists, fmt.Sprintf("%s: %v", message, err))
+	case errors.Is(err, repositories.ErrTimeout):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, repositories.ErrUnavailable):
+		code = codes.Unavailable
+	default:
+		return status.Error(codes.Internal, fmt.Sprintf("%s: %v", message, err))
+	}
+
+	st, detailErr := status.New(code, fmt.Sprintf("%s: %v", message, err)).WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(storageRetryDelay),
+	})
+	if detailErr != nil {
+		return status.Error(code, fmt.Sprintf("%s: %v", message, err))
+	}
+	return st.Err()
+}
+
+// presentUserFields keeps requests without an update_mask working by treating
+// every non-empty field as set. A gender is only written when it is set and
+// not GENDER_UNSPECIFIED.
+func presentUserFields(user *userspb.UserUpdate) []string {
+	paths := []string{}
+
+	if user.GetFirstName() != "" {
+		paths = append(paths, "first_name")
+	}
+
+	if user.GetLastName() != "" {
+		paths = append(paths, "last_name")
+	}
+
+	if user.GetPhNumber() != "" {
+		paths = append(paths, "ph_number")
+	}
+
+	if user.Gender != nil && user.GetGender() != userspb.Gender_GENDER_UNSPECIFIED {
+		paths = append(paths, "gender")
+	}
+
+	if user.GetBirthDate() != nil || user.GetDob() != "" {
+		paths = append(paths, "dob")
+	}
+
+	return paths
+}
+
+func (us *UserService) UpdatePhoneOrEmail(ctx context.Context, req *userspb.UpdatePhoneOrEmailRequest) (*userspb.UserResponse, error) {
+	var violations badRequest
+	currEmail := violations.email(us.emails, "curr_email", req.GetCurrEmail())
+
+	var newPhNumber, newEmail string
+	if req.GetNewPhNumber() != "" {
+		newPhNumber = violations.phone(us.phones, "new_ph_number", req.GetNewPhNumber())
+	}
+	if req.GetNewEmail() != "" {
+		newEmail = violations.email(us.emails, "new_email", req.GetNewEmail())
+	}
+	if req.GetNewPhNumber() == "" && req.GetNewEmail() == "" {
+		violations.add("", "new_email or new_ph_number is required")
+	}
+	// A case variant of the current email is the same email.
+	if newEmail != "" && newEmail == currEmail {
+		violations.add("new_email", fmt.Sprintf("must differ from curr_email, got %q", req.GetNewEmail()))
+	}
+	if err := violations.err(); err != nil {
+		return nil, err
 	}
 
-	user, err := us.userRepo.GetUserByEmail(ctx, req.GetCurrEmail())
+	user, err := us.userRepo.GetUserByEmail(ctx, currEmail)
 	if err != nil {
-		return nil, status.Error(codes.NotFound, fmt.Sprintf("User not found: %v", err))
+		return nil, repositoryError(err, "Error retrieving user")
 	}
 
-	if user.Access == "BLOCKED" {
-		return nil, status.Error(codes.PermissionDenied, "User Access Blocked")
+	if err := tombstoned(user); err != nil {
+		return nil, err
 	}
 
-	if req.GetNewPhNumber() != "" && req.GetNewEmail() == "" {
+	if err := us.accessDenied(user); err != nil {
+		return nil, err
+	}
+
+	expectedVersion, err := resolveExpectedVersion(ctx, req.ExpectedVersion, user.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	defer us.writes.lock(user.ID)()
+	modified := us.modification(ctx)
+
+	if newPhNumber != "" && newEmail == "" {
 		updatedUser := *user
-		updatedUser.PhNumber = req.GetNewPhNumber()
+		updatedUser.PhNumber = newPhNumber
 
-		err = us.userRepo.UpdateUser(ctx, &updatedUser, []string{"ph_number"})
+		applied, err := us.userRepo.UpdateUser(ctx, &updatedUser, []string{"ph_number"}, modified, expectedVersion)
+		if errors.Is(err, repositories.ErrPhoneTaken) {
+			return nil, status.Error(codes.AlreadyExists, "User with phone number already exists")
+		}
 		if err != nil {
-			return nil, status.Error(codes.Internal, fmt.Sprintf("Error updating phone number: %v", err))
+			return nil, repositoryError(err, "Error updating phone number")
+		}
+
+		if !applied {
+			return nil, versionConflict(currEmail)
 		}
 
-		user.PhNumber = req.GetNewPhNumber()
-	} else if req.GetNewEmail() != "" {
-		_, err = us.userRepo.GetUserByEmail(ctx, req.GetNewEmail())
+		user.PhNumber = newPhNumber
+		user.UpdatedAt = modified.At
+		user.UpdatedBy = modified.By
+		user.Version = expectedVersion + 1
+	} else if newEmail != "" {
+		_, err = us.userRepo.GetUserByEmail(ctx, newEmail)
 		if err == nil {
 			return nil, status.Error(codes.AlreadyExists, "User with email already exists")
 		}
+		if !errors.Is(err, repositories.ErrNotFound) {
+			return nil, repositoryError(err, "Error retrieving user")
+		}
+
+		changedUser, err := us.userRepo.ChangeEmail(ctx, user, newEmail, email.Display(req.GetNewEmail()), newPhNumber, modified)
+		if errors.Is(err, repositories.ErrEmailTaken) {
+			return nil, status.Error(codes.AlreadyExists, "User with email already exists")
+		}
+		if errors.Is(err, repositories.ErrPhoneTaken) {
+			return nil, status.Error(codes.AlreadyExists, "User with phone number already exists")
+		}
+		if errors.Is(err, repositories.ErrVersionConflict) {
+			return nil, versionConflict(currEmail)
+		}
+		if err != nil {
+			return nil, repositoryError(err, "Error changing user email")
+		}
+
+		user = changedUser
+	}
+
+	log.Println("User phone/email updated successfully")
 
-		newUser := *user
-		newUser.Email = req.GetNewEmail()
+	res, err := userResponse(user)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Email != currEmail {
+		us.events.Publish(userspb.UserEventType_USER_EMAIL_CHANGED, res, currEmail)
+	} else {
+		us.events.Publish(userspb.UserEventType_USER_UPDATED, res, "")
+	}
+
+	return res, nil
+}
 
-		if req.GetNewPhNumber() != "" {
-			newUser.PhNumber = req.GetNewPhNumber()
+func (us *UserService) BatchCreateUsers(ctx context.Context, req *userspb.BatchCreateUsersRequest) (*userspb.BatchUsersResponse, error) {
+	results := runBatch(len(req.GetUsers()), func(i int) (*userspb.UserResponse, error) {
+		if err := validateRequest(req.GetUsers()[i]); err != nil {
+			return nil, err
 		}
+		return us.CreateUser(ctx, req.GetUsers()[i])
+	})
 
-		created, err := us.userRepo.CreateUser(ctx, &newUser)
-		if err != nil || !created {
-			return nil, status.Error(codes.Internal, fmt.Sprintf("Error creating new user record: %v", err))
+	log.Println("Batch create completed")
+	return &userspb.BatchUsersResponse{Results: results}, nil
+}
+
+func (us *UserService) BatchGetUsers(ctx context.Context, req *userspb.BatchGetUsersRequest) (*userspb.BatchUsersResponse, error) {
+	results := runBatch(len(req.GetUsers()), func(i int) (*userspb.UserResponse, error) {
+		if err := validateRequest(req.GetUsers()[i]); err != nil {
+			return nil, err
 		}
+		return us.GetUser(ctx, req.GetUsers()[i])
+	})
+
+	log.Println("Batch get completed")
+	return &userspb.BatchUsersResponse{Results: results}, nil
+}
+
+// runBatch runs fn for every index with bounded concurrency and records each
+// outcome in request order, so one failing item never fails the whole batch.
+func runBatch(n int, fn func(i int) (*userspb.UserResponse, error)) []*userspb.BatchUserResult {
+	results := make([]*userspb.BatchUserResult, n)
+	sem := make(chan struct{}, batchConcurrency)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			user, err := fn(i)
+			results[i] = &userspb.BatchUserResult{
+				Status: status.Convert(err).Proto(),
+				User:   user,
+			}
+		}(i)
+	}
+	wg.Wait()
 
-		err = us.userRepo.DeleteUser(ctx, req.GetCurrEmail())
+	return results
+}
+
+func (us *UserService) ListUsers(ctx context.Context, req *userspb.ListUsersRequest) (*userspb.ListUsersResponse, error) {
+	pageSize, err := clampPageSize(req.GetPageSize())
+	if err != nil {
+		return nil, err
+	}
+
+	pageState, err := base64.RawURLEncoding.DecodeString(req.GetPageToken())
+	if err != nil {
+		return nil, invalidField("page_token", "is malformed")
+	}
+
+	filter, err := parseUserFilter(req.GetFilter())
+	if err != nil {
+		return nil, err
+	}
+
+	users, nextPageState, err := us.userRepo.ListUsers(ctx, filter, pageSize, pageState)
+	if err != nil {
+		return nil, repositoryError(err, "Error listing users")
+	}
+
+	res := &userspb.ListUsersResponse{
+		Users:         make([]*userspb.UserResponse, 0, len(users)),
+		NextPageToken: base64.RawURLEncoding.EncodeToString(nextPageState),
+	}
+
+	for _, user := range users {
+		userRes, err := userResponse(&user)
 		if err != nil {
-			log.Printf("Warning: Failed to delete old user record: %v", err)
+			return nil, err
 		}
+		res.Users = append(res.Users, userRes)
+	}
+
+	log.Println("Users listed successfully")
+	return res, nil
+}
 
-		*user = newUser
+// clampPageSize applies the default to an unset page size and caps it. The
+// validation interceptor rejects negative sizes too, but callers that bypass
+// it must not reach the repositories with one.
+func clampPageSize(requested int32) (int, error) {
+	if requested < 0 {
+		return 0, invalidField("page_size", "must not be negative")
+	}
+	if requested == 0 {
+		return defaultPageSize, nil
+	}
+	if requested > maxPageSize {
+		return maxPageSize, nil
 	}
+	return int(requested), nil
+}
 
-	log.Println("User phone/email updated successfully")
+func parseUserFilter(f *userspb.UserFilter) (*models.UserFilter, error) {
+	if f == nil {
+		return nil, nil
+	}
+
+	filter := &models.UserFilter{
+		Access: convert.Accesses(),
+		Gender: convert.Genders(),
+	}
+
+	var violations badRequest
+
+	if f.Access != nil {
+		filter.Access = []string{violations.access("filter.access", f.GetAccess())}
+	}
+
+	if f.Gender != nil {
+		filter.Gender = []string{violations.gender("filter.gender", f.GetGender())}
+	}
+
+	filter.Deleted = f.GetDeleted()
+
+	if f.GetBirthDateFrom() != nil {
+		dobFrom := violations.calendarDate("filter.birth_date_from", f.GetBirthDateFrom())
+		filter.DobFrom = &dobFrom
+	} else if f.GetDobFrom() != "" {
+		dobFrom := violations.date("filter.dob_from", f.GetDobFrom())
+		filter.DobFrom = &dobFrom
+	}
+
+	if f.GetBirthDateTo() != nil {
+		dobTo := violations.calendarDate("filter.birth_date_to", f.GetBirthDateTo())
+		filter.DobTo = &dobTo
+	} else if f.GetDobTo() != "" {
+		dobTo := violations.date("filter.dob_to", f.GetDobTo())
+		filter.DobTo = &dobTo
+	}
 
-	return &userspb.UserResponse{
-		Email:     user.Email,
-		FirstName: user.FirstName,
-		LastName:  user.LastName,
-		PhNumber:  user.PhNumber,
-		Gender:    models.GenderStrToGender(user.Gender),
-		Dob:       user.Dob.Format(time.RFC3339),
-		Access:    models.AccessStrToAccess(user.Access),
+	if err := violations.err(); err != nil {
+		return nil, err
+	}
+
+	if filter.DobFrom != nil && filter.DobTo != nil && filter.DobFrom.After(*filter.DobTo) {
+		fromField, toField := "filter.dob_from", "filter.dob_to"
+		if f.GetBirthDateFrom() != nil {
+			fromField = "filter.birth_date_from"
+		}
+		if f.GetBirthDateTo() != nil {
+			toField = "filter.birth_date_to"
+		}
+		return nil, invalidField(fromField, "must not be after "+toField)
+	}
+
+	return filter, nil
+}
+
+// DeleteUser only marks the user deleted. It can be brought back with
+// RestoreUser until the retention has passed and the purge removes it.
+func (us *UserService) DeleteUser(ctx context.Context, req *userspb.DeleteUserRequest) (*userspb.DeleteUserResponse, error) {
+	canonicalEmail, err := us.canonicalEmail("email", req.GetEmail())
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := us.userRepo.GetUserByEmail(ctx, canonicalEmail)
+	if err != nil {
+		return nil, repositoryError(err, "Error retrieving user")
+	}
+
+	if err := tombstoned(user); err != nil {
+		return nil, err
+	}
+
+	expectedVersion, err := resolveExpectedVersion(ctx, req.ExpectedVersion, user.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	defer us.writes.lock(user.ID)()
+	modified := us.modification(ctx)
+	applied, err := us.userRepo.DeleteUser(ctx, user.ID, modified, expectedVersion)
+	if err != nil {
+		return nil, repositoryError(err, "Error deleting user")
+	}
+
+	if !applied {
+		return nil, versionConflict(canonicalEmail)
+	}
+
+	user.DeletedAt = modified.At
+	user.DeletedBy = modified.By
+	user.UpdatedAt = modified.At
+	user.UpdatedBy = modified.By
+	user.Version = expectedVersion + 1
+
+	us.announce(userspb.UserEventType_USER_DELETED, user)
+
+	log.Println("User deleted successfully")
+	return &userspb.DeleteUserResponse{
+		Email:           user.Email,
+		DeletedAt:       timestamppb.New(modified.At),
+		RestorableUntil: timestamppb.New(modified.At.Add(us.retention)),
 	}, nil
 }
+
+func (us *UserService) RestoreUser(ctx context.Context, req *userspb.RestoreUserRequest) (*userspb.UserResponse, error) {
+	canonicalEmail, err := us.canonicalEmail("email", req.GetEmail())
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := us.userRepo.GetUserByEmail(ctx, canonicalEmail)
+	if err != nil {
+		return nil, repositoryError(err, "Error retrieving user")
+	}
+
+	if user.DeletedAt.IsZero() {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("No deleted user with email %s", canonicalEmail))
+	}
+
+	// Past the retention the purge may remove the user at any moment.
+	if restorableUntil := user.DeletedAt.Add(us.retention); !us.now().Before(restorableUntil) {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("User %s could only be restored until %s", canonicalEmail, restorableUntil.Format(time.RFC3339)))
+	}
+
+	expectedVersion, err := resolveExpectedVersion(ctx, req.ExpectedVersion, user.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	defer us.writes.lock(user.ID)()
+	modified := us.modification(ctx)
+	applied, err := us.userRepo.RestoreUser(ctx, user.ID, modified, expectedVersion)
+	if err != nil {
+		return nil, repositoryError(err, "Error restoring user")
+	}
+
+	if !applied {
+		return nil, versionConflict(canonicalEmail)
+	}
+
+	user.DeletedAt = time.Time{}
+	user.DeletedBy = ""
+	user.UpdatedAt = modified.At
+	user.UpdatedBy = modified.By
+	user.Version = expectedVersion + 1
+
+	log.Println("User restored successfully")
+	res, err := userResponse(user)
+	if err != nil {
+		return nil, err
+	}
+
+	us.events.Publish(userspb.UserEventType_USER_RESTORED, res, "")
+	return res, nil
+}
+
+func (us *UserService) WatchUsers(req *userspb.WatchUsersRequest, stream userspb.Users_WatchUsersServer) error {
+	var watched string
+	if req.Email != nil {
+		var err error
+		if watched, err = us.canonicalEmail("email", req.GetEmail()); err != nil {
+			return err
+		}
+	}
+
+	backlog, sub, err := us.events.Subscribe(req.GetCursor(), watcherChannelSize)
+	if errors.Is(err, events.ErrCursorExpired) {
+		return status.Error(codes.OutOfRange, fmt.Sprintf("Cursor expired: %v", err))
+	}
+	if errors.Is(err, events.ErrUnknownCursor) {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("Cursor cannot be resumed here: %v, list users again and watch without a cursor", err))
+	}
+	if err != nil {
+		return invalidField("cursor", fmt.Sprintf("is malformed: %v", err))
+	}
+	defer sub.Cancel()
+
+	// The headers tell the client that the stream is subscribed and will
+	// not miss later events.
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+
+	for _, event := range backlog {
+		if !eventMatches(event, watched) {
+			continue
+		}
+		if err := stream.Send(event); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event, ok := <-sub.Events:
+			if !ok {
+				return status.Error(codes.Aborted, "Watcher fell behind, resume from the last received cursor")
+			}
+			if !eventMatches(event, watched) {
+				continue
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// eventMatches reports whether event concerns the user with the canonical
+// email watched, or any user when watched is empty.
+func eventMatches(event *userspb.UserEvent, watched string) bool {
+	if watched == "" {
+		return true
+	}
+	return event.GetUser().GetEmail() == watched || event.GetPreviousEmail() == watched
+}
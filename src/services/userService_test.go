@@ -0,0 +1,1004 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	userspb "2k4sm/grpc-crud/proto/users"
+	"2k4sm/grpc-crud/src/email"
+	"2k4sm/grpc-crud/src/phone"
+	"2k4sm/grpc-crud/src/repositories"
+
+	"github.com/gocql/gocql"
+	"google.golang.org/genproto/googleapis/type/date"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// testRetention is how long deleted users stay restorable in the tests.
+const testRetention = time.Hour
+
+// newTestService serves a UserService backed by the in-memory repository over
+// an in-process connection, behind the same interceptors as main.go. The
+// service is returned too, for the background jobs and the clock.
+func newTestService(t *testing.T, retention time.Duration) (userspb.UsersClient, *UserService) {
+	t.Helper()
+
+	phones, err := phone.NewNormalizer("IN")
+	if err != nil {
+		t.Fatalf("NewNormalizer: %v", err)
+	}
+
+	service := NewUserService(repositories.NewInMemoryUserRepository(), phones, email.NewCanonicalizer(false), retention)
+
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(UnaryValidationInterceptor),
+		grpc.ChainStreamInterceptor(StreamValidationInterceptor),
+	)
+	userspb.RegisterUsersServer(server, service)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return userspb.NewUsersClient(conn), service
+}
+
+func newTestClient(t *testing.T) userspb.UsersClient {
+	t.Helper()
+
+	client, _ := newTestService(t, testRetention)
+	return client
+}
+
+// testClock is a service clock that only moves when advanced.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// setTestClock makes service read the time from a testClock starting now.
+func setTestClock(service *UserService) *testClock {
+	clock := &testClock{now: time.Now()}
+	service.now = clock.Now
+	return clock
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// userRequest returns a valid request for the nth test user.
+func userRequest(n int) *userspb.UserRequest {
+	return &userspb.UserRequest{
+		FirstName:   "First",
+		LastName:    "Last",
+		Gender:      userspb.Gender_FEMALE.Enum(),
+		DateOfBirth: &userspb.UserRequest_BirthDate{BirthDate: &date.Date{Year: 1990, Month: 1, Day: int32(1 + n%28)}},
+		PhNumber:    fmt.Sprintf("98765%05d", n),
+		Email:       fmt.Sprintf("user%d@example.com", n),
+	}
+}
+
+func createUser(t *testing.T, client userspb.UsersClient, n int) *userspb.UserResponse {
+	t.Helper()
+
+	user, err := client.CreateUser(context.Background(), userRequest(n))
+	if err != nil {
+		t.Fatalf("CreateUser(%d): %v", n, err)
+	}
+	return user
+}
+
+func assertCode(t *testing.T, err error, want codes.Code) {
+	t.Helper()
+
+	if got := status.Code(err); got != want {
+		t.Fatalf("got code %v (%v), want %v", got, err, want)
+	}
+}
+
+func TestDeleteUserNotFound(t *testing.T) {
+	client := newTestClient(t)
+
+	_, err := client.DeleteUser(context.Background(), &userspb.DeleteUserRequest{Email: "missing@example.com"})
+	assertCode(t, err, codes.NotFound)
+}
+
+func TestDeleteUserRequiresEmail(t *testing.T) {
+	client := newTestClient(t)
+
+	_, err := client.DeleteUser(context.Background(), &userspb.DeleteUserRequest{})
+	assertCode(t, err, codes.InvalidArgument)
+}
+
+func TestDeleteUser(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+	user := createUser(t, client, 1)
+
+	// The response carries the stored email, not the one typed.
+	res, err := client.DeleteUser(ctx, &userspb.DeleteUserRequest{Email: "User1@Example.com"})
+	if err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if res.GetEmail() != user.GetEmail() {
+		t.Fatalf("got email %q, want %q", res.GetEmail(), user.GetEmail())
+	}
+	if res.GetDeletedAt() == nil {
+		t.Fatal("deleted_at is not set")
+	}
+	if got, want := res.GetRestorableUntil().AsTime(), res.GetDeletedAt().AsTime().Add(testRetention); !got.Equal(want) {
+		t.Fatalf("got restorable_until %v, want %v", got, want)
+	}
+
+	// A deleted user is hidden like a missing one.
+	_, err = client.GetUser(ctx, &userspb.GetUserRequest{Email: &user.Email})
+	assertCode(t, err, codes.NotFound)
+
+	_, err = client.GetUserById(ctx, &userspb.GetUserByIdRequest{Id: user.GetId()})
+	assertCode(t, err, codes.NotFound)
+
+	_, err = client.DeleteUser(ctx, &userspb.DeleteUserRequest{Email: user.GetEmail()})
+	assertCode(t, err, codes.NotFound)
+
+	restored, err := client.RestoreUser(ctx, &userspb.RestoreUserRequest{Email: user.GetEmail()})
+	if err != nil {
+		t.Fatalf("RestoreUser: %v", err)
+	}
+	if restored.GetId() != user.GetId() || restored.GetDeletedAt() != nil || restored.GetVersion() != user.GetVersion()+2 {
+		t.Fatalf("got restored user %v, want %s undeleted at version %d", restored, user.GetId(), user.GetVersion()+2)
+	}
+
+	got, err := client.GetUser(ctx, &userspb.GetUserRequest{Email: &user.Email})
+	if err != nil {
+		t.Fatalf("GetUser after restore: %v", err)
+	}
+	if got.GetFirstName() != user.GetFirstName() || got.GetPhNumber() != user.GetPhNumber() {
+		t.Fatalf("got user %v after restore, want %v", got, user)
+	}
+}
+
+func TestDeleteUserStaleVersion(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+	user := createUser(t, client, 1)
+
+	stale := user.GetVersion() + 1
+	_, err := client.DeleteUser(ctx, &userspb.DeleteUserRequest{Email: user.GetEmail(), ExpectedVersion: &stale})
+	assertCode(t, err, codes.FailedPrecondition)
+
+	if _, err := client.GetUser(ctx, &userspb.GetUserRequest{Email: &user.Email}); err != nil {
+		t.Fatalf("GetUser after a rejected delete: %v", err)
+	}
+}
+
+func TestCreateUser(t *testing.T) {
+	client := newTestClient(t)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), actorMetadataKey, "tester")
+
+	req := userRequest(1)
+	req.Email = "User1@Example.com"
+
+	user, err := client.CreateUser(ctx, req)
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	if user.GetId() == "" || user.GetEmail() != "user1@example.com" || user.GetDisplayEmail() != "User1@Example.com" ||
+		user.GetPhNumber() != "+919876500001" || user.GetGender() != userspb.Gender_FEMALE || user.GetAccess() != userspb.Access_UNBLOCKED ||
+		user.GetVersion() != 1 || user.GetCreatedBy() != "tester" || user.GetCreatedAt() == nil {
+		t.Fatalf("got user %v", user)
+	}
+	if got := user.GetBirthDate(); got.GetYear() != 1990 || got.GetMonth() != 1 || got.GetDay() != 2 {
+		t.Fatalf("got birth_date %v, want 1990-01-02", got)
+	}
+
+	// MALE is the zero value, so only a gender that is left out is
+	// GENDER_UNSPECIFIED.
+	for _, tt := range []struct {
+		n      int
+		gender *userspb.Gender
+		want   userspb.Gender
+	}{
+		{3, nil, userspb.Gender_GENDER_UNSPECIFIED},
+		{4, userspb.Gender_MALE.Enum(), userspb.Gender_MALE},
+	} {
+		req := userRequest(tt.n)
+		req.Gender = tt.gender
+		user, err := client.CreateUser(ctx, req)
+		if err != nil {
+			t.Fatalf("CreateUser(%v): %v", tt.gender, err)
+		}
+		if user.GetGender() != tt.want {
+			t.Fatalf("got gender %v for %v, want %v", user.GetGender(), tt.gender, tt.want)
+		}
+	}
+
+	// userRequest leaves access out, which is told apart from BLOCKED, the
+	// zero value, by presence. An explicit UNBLOCKED is accepted too.
+	req = userRequest(5)
+	req.Access = userspb.Access_UNBLOCKED.Enum()
+	if user, err := client.CreateUser(ctx, req); err != nil || user.GetAccess() != userspb.Access_UNBLOCKED {
+		t.Fatalf("CreateUser with UNBLOCKED: got %v, %v, want an UNBLOCKED user", user, err)
+	}
+
+	tests := []struct {
+		name string
+		req  func() *userspb.UserRequest
+		want codes.Code
+	}{
+		{"duplicate email", func() *userspb.UserRequest {
+			req := userRequest(2)
+			req.Email = "USER1@example.com"
+			return req
+		}, codes.AlreadyExists},
+		{"duplicate phone", func() *userspb.UserRequest {
+			req := userRequest(2)
+			req.PhNumber = "+91 98765 00001"
+			return req
+		}, codes.AlreadyExists},
+		{"missing email", func() *userspb.UserRequest {
+			req := userRequest(2)
+			req.Email = ""
+			return req
+		}, codes.InvalidArgument},
+		{"blocked", func() *userspb.UserRequest {
+			req := userRequest(2)
+			req.Access = userspb.Access_BLOCKED.Enum()
+			return req
+		}, codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := client.CreateUser(ctx, tt.req())
+			assertCode(t, err, tt.want)
+		})
+	}
+}
+
+func TestGetUser(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+	user := createUser(t, client, 1)
+	other := createUser(t, client, 2)
+
+	upperEmail := "USER1@EXAMPLE.COM"
+	localPhone := "9876500001"
+	missing := "missing@example.com"
+
+	tests := []struct {
+		name string
+		req  *userspb.GetUserRequest
+		want codes.Code
+	}{
+		{"email", &userspb.GetUserRequest{Email: &upperEmail}, codes.OK},
+		{"phone", &userspb.GetUserRequest{PhNumber: &localPhone}, codes.OK},
+		{"email and phone", &userspb.GetUserRequest{Email: &user.Email, PhNumber: &user.PhNumber}, codes.OK},
+		{"email and other phone", &userspb.GetUserRequest{Email: &user.Email, PhNumber: &other.PhNumber}, codes.NotFound},
+		{"missing", &userspb.GetUserRequest{Email: &missing}, codes.NotFound},
+		{"neither", &userspb.GetUserRequest{}, codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := client.GetUser(ctx, tt.req)
+			assertCode(t, err, tt.want)
+			if err == nil && got.GetId() != user.GetId() {
+				t.Fatalf("got user %s, want %s", got.GetId(), user.GetId())
+			}
+		})
+	}
+}
+
+func TestGetUserById(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+	user := createUser(t, client, 1)
+
+	got, err := client.GetUserById(ctx, &userspb.GetUserByIdRequest{Id: user.GetId()})
+	if err != nil {
+		t.Fatalf("GetUserById: %v", err)
+	}
+	if got.GetEmail() != user.GetEmail() {
+		t.Fatalf("got email %q, want %q", got.GetEmail(), user.GetEmail())
+	}
+
+	_, err = client.GetUserById(ctx, &userspb.GetUserByIdRequest{Id: gocql.TimeUUID().String()})
+	assertCode(t, err, codes.NotFound)
+
+	_, err = client.GetUserById(ctx, &userspb.GetUserByIdRequest{Id: "not-a-uuid"})
+	assertCode(t, err, codes.InvalidArgument)
+}
+
+func TestUpdateUser(t *testing.T) {
+	client := newTestClient(t)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), actorMetadataKey, "editor")
+	user := createUser(t, client, 1)
+	other := createUser(t, client, 2)
+
+	// Only the fields named by the mask are written.
+	updated, err := client.UpdateUser(ctx, &userspb.UpdateUserRequest{
+		Email:           user.GetEmail(),
+		User:            &userspb.UserUpdate{FirstName: "Renamed", LastName: "Ignored"},
+		UpdateMask:      &fieldmaskpb.FieldMask{Paths: []string{"first_name"}},
+		ExpectedVersion: &user.Version,
+	})
+	if err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+	if updated.GetFirstName() != "Renamed" || updated.GetLastName() != user.GetLastName() ||
+		updated.GetVersion() != user.GetVersion()+1 || updated.GetUpdatedBy() != "editor" {
+		t.Fatalf("got updated user %v", updated)
+	}
+
+	// Without a mask every non-empty field is written.
+	updated, err = client.UpdateUser(ctx, &userspb.UpdateUserRequest{
+		Email: user.GetEmail(),
+		User: &userspb.UserUpdate{
+			Gender:      userspb.Gender_NON_BINARY.Enum(),
+			DateOfBirth: &userspb.UserUpdate_BirthDate{BirthDate: &date.Date{Year: 1985, Month: 6, Day: 15}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("UpdateUser without mask: %v", err)
+	}
+	if updated.GetGender() != userspb.Gender_NON_BINARY || updated.GetBirthDate().GetYear() != 1985 || updated.GetFirstName() != "Renamed" {
+		t.Fatalf("got updated user %v", updated)
+	}
+
+	stale := user.GetVersion()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		req  *userspb.UpdateUserRequest
+		want codes.Code
+	}{
+		{"stale expected_version", ctx, &userspb.UpdateUserRequest{
+			Email:           user.GetEmail(),
+			User:            &userspb.UserUpdate{FirstName: "Stale"},
+			ExpectedVersion: &stale,
+		}, codes.FailedPrecondition},
+		{"stale If-Match", metadata.AppendToOutgoingContext(ctx, "if-match", `"1"`), &userspb.UpdateUserRequest{
+			Email: user.GetEmail(),
+			User:  &userspb.UserUpdate{FirstName: "Stale"},
+		}, codes.FailedPrecondition},
+		{"access in mask", ctx, &userspb.UpdateUserRequest{
+			Email:      user.GetEmail(),
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"access"}},
+		}, codes.InvalidArgument},
+		{"unknown field in mask", ctx, &userspb.UpdateUserRequest{
+			Email:      user.GetEmail(),
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"email"}},
+		}, codes.InvalidArgument},
+		{"nothing to update", ctx, &userspb.UpdateUserRequest{
+			Email: user.GetEmail(),
+			User:  &userspb.UserUpdate{},
+		}, codes.InvalidArgument},
+		{"taken phone", ctx, &userspb.UpdateUserRequest{
+			Email: user.GetEmail(),
+			User:  &userspb.UserUpdate{PhNumber: other.GetPhNumber()},
+		}, codes.AlreadyExists},
+		{"missing user", ctx, &userspb.UpdateUserRequest{
+			Email: "missing@example.com",
+			User:  &userspb.UserUpdate{FirstName: "Nobody"},
+		}, codes.NotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := client.UpdateUser(tt.ctx, tt.req)
+			assertCode(t, err, tt.want)
+		})
+	}
+
+	got, err := client.GetUser(ctx, &userspb.GetUserRequest{Email: &user.Email})
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if got.GetFirstName() != "Renamed" || got.GetVersion() != user.GetVersion()+2 {
+		t.Fatalf("rejected updates changed the user: %v", got)
+	}
+}
+
+func TestBlockAndUnblockUser(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+	user := createUser(t, client, 1)
+
+	until := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	blocked, err := client.BlockUser(ctx, &userspb.BlockUserRequest{
+		Email:  user.GetEmail(),
+		Reason: "Cooling-off period",
+		Access: userspb.Access_SUSPENDED,
+		Until:  timestamppb.New(until),
+	})
+	if err != nil {
+		t.Fatalf("BlockUser: %v", err)
+	}
+	if blocked.GetAccess() != userspb.Access_SUSPENDED || !blocked.GetAccessExpiresAt().AsTime().Equal(until) || blocked.GetVersion() != user.GetVersion()+1 {
+		t.Fatalf("got blocked user %v", blocked)
+	}
+
+	_, err = client.GetUser(ctx, &userspb.GetUserRequest{Email: &user.Email})
+	assertCode(t, err, codes.PermissionDenied)
+
+	_, err = client.UpdateUser(ctx, &userspb.UpdateUserRequest{Email: user.GetEmail(), User: &userspb.UserUpdate{FirstName: "Denied"}})
+	assertCode(t, err, codes.PermissionDenied)
+
+	unblocked, err := client.UnblockUser(ctx, &userspb.UserAccessUpdateRequest{Email: user.GetEmail(), Reason: "Appeal accepted"})
+	if err != nil {
+		t.Fatalf("UnblockUser: %v", err)
+	}
+	if unblocked.GetAccess() != userspb.Access_UNBLOCKED || unblocked.GetAccessExpiresAt() != nil {
+		t.Fatalf("got unblocked user %v", unblocked)
+	}
+
+	if _, err := client.GetUser(ctx, &userspb.GetUserRequest{Email: &user.Email}); err != nil {
+		t.Fatalf("GetUser after unblock: %v", err)
+	}
+
+	past := timestamppb.New(time.Now().Add(-time.Hour))
+	tests := []struct {
+		name string
+		req  *userspb.BlockUserRequest
+		want codes.Code
+	}{
+		{"no reason", &userspb.BlockUserRequest{Email: user.GetEmail()}, codes.InvalidArgument},
+		{"suspended without until", &userspb.BlockUserRequest{Email: user.GetEmail(), Reason: "x", Access: userspb.Access_SUSPENDED}, codes.InvalidArgument},
+		{"until in the past", &userspb.BlockUserRequest{Email: user.GetEmail(), Reason: "x", Until: past}, codes.InvalidArgument},
+		{"missing user", &userspb.BlockUserRequest{Email: "missing@example.com", Reason: "x"}, codes.NotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := client.BlockUser(ctx, tt.req)
+			assertCode(t, err, tt.want)
+		})
+	}
+}
+
+func TestAccessExpiry(t *testing.T) {
+	client, service := newTestService(t, testRetention)
+	clock := setTestClock(service)
+	ctx := context.Background()
+	user := createUser(t, client, 1)
+
+	_, err := client.BlockUser(ctx, &userspb.BlockUserRequest{
+		Email:  user.GetEmail(),
+		Reason: "Short break",
+		Until:  timestamppb.New(clock.Now().Add(time.Hour)),
+	})
+	if err != nil {
+		t.Fatalf("BlockUser: %v", err)
+	}
+
+	lifted, err := service.LiftExpiredAccess(ctx)
+	if err != nil {
+		t.Fatalf("LiftExpiredAccess: %v", err)
+	}
+	if lifted != 0 {
+		t.Fatalf("lifted %d blocks before they ended, want 0", lifted)
+	}
+
+	clock.Advance(time.Hour)
+
+	// An ended block no longer denies access, even before it is lifted.
+	if _, err := client.GetUser(ctx, &userspb.GetUserRequest{Email: &user.Email}); err != nil {
+		t.Fatalf("GetUser after the block ended: %v", err)
+	}
+
+	lifted, err = service.LiftExpiredAccess(ctx)
+	if err != nil {
+		t.Fatalf("LiftExpiredAccess: %v", err)
+	}
+	if lifted != 1 {
+		t.Fatalf("lifted %d blocks, want 1", lifted)
+	}
+
+	history, err := client.GetAccessHistory(ctx, &userspb.GetAccessHistoryRequest{Email: user.GetEmail()})
+	if err != nil {
+		t.Fatalf("GetAccessHistory: %v", err)
+	}
+	if len(history.GetChanges()) != 2 || history.GetChanges()[0].GetAccess() != userspb.Access_UNBLOCKED || history.GetChanges()[0].GetChangedBy() != accessExpiryActor {
+		t.Fatalf("got access history %v", history.GetChanges())
+	}
+}
+
+func TestGetAccessHistory(t *testing.T) {
+	client, service := newTestService(t, testRetention)
+	ctx := context.Background()
+	user := createUser(t, client, 1)
+
+	for _, access := range []userspb.Access{userspb.Access_BLOCKED, userspb.Access_LOCKED} {
+		if _, err := client.BlockUser(ctx, &userspb.BlockUserRequest{Email: user.GetEmail(), Reason: access.String(), Access: access}); err != nil {
+			t.Fatalf("BlockUser: %v", err)
+		}
+		if _, err := client.UnblockUser(ctx, &userspb.UserAccessUpdateRequest{Email: user.GetEmail()}); err != nil {
+			t.Fatalf("UnblockUser: %v", err)
+		}
+	}
+
+	var changes []*userspb.AccessChange
+	var pages int
+	pageToken := ""
+	for {
+		res, err := client.GetAccessHistory(ctx, &userspb.GetAccessHistoryRequest{Email: user.GetEmail(), PageSize: 3, PageToken: pageToken})
+		if err != nil {
+			t.Fatalf("GetAccessHistory: %v", err)
+		}
+		changes = append(changes, res.GetChanges()...)
+		pages++
+
+		if res.GetNextPageToken() == "" {
+			break
+		}
+		pageToken = res.GetNextPageToken()
+	}
+
+	if pages != 2 || len(changes) != 4 {
+		t.Fatalf("got %d changes on %d pages, want 4 on 2", len(changes), pages)
+	}
+
+	// Newest first, each change recording the state it left.
+	want := []struct{ access, previous userspb.Access }{
+		{userspb.Access_UNBLOCKED, userspb.Access_LOCKED},
+		{userspb.Access_LOCKED, userspb.Access_UNBLOCKED},
+		{userspb.Access_UNBLOCKED, userspb.Access_BLOCKED},
+		{userspb.Access_BLOCKED, userspb.Access_UNBLOCKED},
+	}
+	for i, change := range changes {
+		if change.GetAccess() != want[i].access || change.GetPreviousAccess() != want[i].previous || change.GetVersion() != user.GetVersion()+int64(4-i) {
+			t.Fatalf("change %d is %v, want %v from %v at version %d", i, change, want[i].access, want[i].previous, user.GetVersion()+int64(4-i))
+		}
+	}
+
+	_, err := client.GetAccessHistory(ctx, &userspb.GetAccessHistoryRequest{Email: user.GetEmail(), PageToken: "not base64!"})
+	assertCode(t, err, codes.InvalidArgument)
+
+	_, err = client.GetAccessHistory(ctx, &userspb.GetAccessHistoryRequest{Email: "missing@example.com"})
+	assertCode(t, err, codes.NotFound)
+
+	// Negative page sizes are rejected even without the interceptor.
+	_, err = service.GetAccessHistory(ctx, &userspb.GetAccessHistoryRequest{Email: user.GetEmail(), PageSize: -1})
+	assertCode(t, err, codes.InvalidArgument)
+}
+
+func TestUpdatePhoneOrEmail(t *testing.T) {
+	client, service := newTestService(t, testRetention)
+	ctx := context.Background()
+	user := createUser(t, client, 1)
+	other := createUser(t, client, 2)
+
+	newPhone := "9876511111"
+	updated, err := client.UpdatePhoneOrEmail(ctx, &userspb.UpdatePhoneOrEmailRequest{CurrEmail: user.GetEmail(), NewPhNumber: &newPhone})
+	if err != nil {
+		t.Fatalf("UpdatePhoneOrEmail(phone): %v", err)
+	}
+	if updated.GetPhNumber() != "+919876511111" || updated.GetVersion() != user.GetVersion()+1 {
+		t.Fatalf("got user %v after phone change", updated)
+	}
+
+	newEmail := "Renamed@Example.com"
+	updated, err = client.UpdatePhoneOrEmail(ctx, &userspb.UpdatePhoneOrEmailRequest{CurrEmail: user.GetEmail(), NewEmail: &newEmail})
+	if err != nil {
+		t.Fatalf("UpdatePhoneOrEmail(email): %v", err)
+	}
+	if updated.GetEmail() != "renamed@example.com" || updated.GetDisplayEmail() != newEmail || updated.GetId() != user.GetId() {
+		t.Fatalf("got user %v after email change", updated)
+	}
+
+	_, err = client.GetUser(ctx, &userspb.GetUserRequest{Email: &user.Email})
+	assertCode(t, err, codes.NotFound)
+
+	if _, err := client.GetUser(ctx, &userspb.GetUserRequest{Email: &updated.Email}); err != nil {
+		t.Fatalf("GetUser(new email): %v", err)
+	}
+
+	stale := user.GetVersion()
+	tests := []struct {
+		name string
+		req  *userspb.UpdatePhoneOrEmailRequest
+		want codes.Code
+	}{
+		{"taken email", &userspb.UpdatePhoneOrEmailRequest{CurrEmail: updated.GetEmail(), NewEmail: &other.Email}, codes.AlreadyExists},
+		{"taken phone", &userspb.UpdatePhoneOrEmailRequest{CurrEmail: updated.GetEmail(), NewPhNumber: &other.PhNumber}, codes.AlreadyExists},
+		{"stale version", &userspb.UpdatePhoneOrEmailRequest{CurrEmail: updated.GetEmail(), NewPhNumber: &newPhone, ExpectedVersion: &stale}, codes.FailedPrecondition},
+		{"nothing to change", &userspb.UpdatePhoneOrEmailRequest{CurrEmail: updated.GetEmail()}, codes.InvalidArgument},
+		{"same email", &userspb.UpdatePhoneOrEmailRequest{CurrEmail: updated.GetEmail(), NewEmail: &updated.Email}, codes.InvalidArgument},
+		{"same email in another case", &userspb.UpdatePhoneOrEmailRequest{CurrEmail: updated.GetEmail(), NewEmail: &newEmail}, codes.InvalidArgument},
+		{"missing user", &userspb.UpdatePhoneOrEmailRequest{CurrEmail: "missing@example.com", NewPhNumber: &newPhone}, codes.NotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := client.UpdatePhoneOrEmail(ctx, tt.req)
+			assertCode(t, err, tt.want)
+		})
+	}
+
+	// A request with nothing to change is rejected even without the
+	// interceptor.
+	_, err = service.UpdatePhoneOrEmail(ctx, &userspb.UpdatePhoneOrEmailRequest{CurrEmail: updated.GetEmail()})
+	assertCode(t, err, codes.InvalidArgument)
+}
+
+func TestBatchCreateAndGetUsers(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+	createUser(t, client, 1)
+
+	invalid := userRequest(3)
+	invalid.Email = ""
+
+	// Requests are created concurrently, so the duplicate is of an existing
+	// user rather than of another request.
+	created, err := client.BatchCreateUsers(ctx, &userspb.BatchCreateUsersRequest{
+		Users: []*userspb.UserRequest{userRequest(4), userRequest(2), userRequest(1), invalid},
+	})
+	if err != nil {
+		t.Fatalf("BatchCreateUsers: %v", err)
+	}
+
+	wantCodes := []codes.Code{codes.OK, codes.OK, codes.AlreadyExists, codes.InvalidArgument}
+	if len(created.GetResults()) != len(wantCodes) {
+		t.Fatalf("got %d results, want %d", len(created.GetResults()), len(wantCodes))
+	}
+	for i, result := range created.GetResults() {
+		if got := codes.Code(result.GetStatus().GetCode()); got != wantCodes[i] {
+			t.Fatalf("result %d has code %v, want %v", i, got, wantCodes[i])
+		}
+	}
+	if created.GetResults()[1].GetUser().GetEmail() != "user2@example.com" {
+		t.Fatalf("result 1 carries user %v", created.GetResults()[1].GetUser())
+	}
+
+	missing := "missing@example.com"
+	phone := created.GetResults()[1].GetUser().GetPhNumber()
+	got, err := client.BatchGetUsers(ctx, &userspb.BatchGetUsersRequest{
+		Users: []*userspb.GetUserRequest{{Email: &missing}, {PhNumber: &phone}, {}},
+	})
+	if err != nil {
+		t.Fatalf("BatchGetUsers: %v", err)
+	}
+
+	wantCodes = []codes.Code{codes.NotFound, codes.OK, codes.InvalidArgument}
+	for i, result := range got.GetResults() {
+		if got := codes.Code(result.GetStatus().GetCode()); got != wantCodes[i] {
+			t.Fatalf("result %d has code %v, want %v", i, got, wantCodes[i])
+		}
+	}
+	if got.GetResults()[1].GetUser().GetEmail() != "user2@example.com" {
+		t.Fatalf("result 1 carries user %v", got.GetResults()[1].GetUser())
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	client, service := newTestService(t, testRetention)
+	ctx := context.Background()
+
+	users := map[string]*userspb.UserResponse{}
+	for n := 1; n <= 5; n++ {
+		req := userRequest(n)
+		if n%2 == 0 {
+			req.Gender = userspb.Gender_MALE.Enum()
+		}
+		user, err := client.CreateUser(ctx, req)
+		if err != nil {
+			t.Fatalf("CreateUser(%d): %v", n, err)
+		}
+		users[user.GetEmail()] = user
+	}
+
+	if _, err := client.BlockUser(ctx, &userspb.BlockUserRequest{Email: "user3@example.com", Reason: "x"}); err != nil {
+		t.Fatalf("BlockUser: %v", err)
+	}
+	if _, err := client.DeleteUser(ctx, &userspb.DeleteUserRequest{Email: "user5@example.com"}); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+
+	list := func(filter *userspb.UserFilter, pageSize int32) (emails map[string]bool, pages int) {
+		t.Helper()
+
+		emails = map[string]bool{}
+		pageToken := ""
+		for {
+			res, err := client.ListUsers(ctx, &userspb.ListUsersRequest{PageSize: pageSize, PageToken: pageToken, Filter: filter})
+			if err != nil {
+				t.Fatalf("ListUsers: %v", err)
+			}
+			pages++
+
+			for _, user := range res.GetUsers() {
+				if emails[user.GetEmail()] {
+					t.Fatalf("user %s listed twice", user.GetEmail())
+				}
+				emails[user.GetEmail()] = true
+			}
+
+			if res.GetNextPageToken() == "" {
+				return emails, pages
+			}
+			pageToken = res.GetNextPageToken()
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter *userspb.UserFilter
+		want   []int
+	}{
+		{"no filter", nil, []int{1, 2, 3, 4}},
+		{"gender", &userspb.UserFilter{Gender: userspb.Gender_MALE.Enum()}, []int{2, 4}},
+		{"access", &userspb.UserFilter{Access: userspb.Access_BLOCKED.Enum()}, []int{3}},
+		{"birth date range", &userspb.UserFilter{
+			From: &userspb.UserFilter_BirthDateFrom{BirthDateFrom: &date.Date{Year: 1990, Month: 1, Day: 3}},
+			To:   &userspb.UserFilter_BirthDateTo{BirthDateTo: &date.Date{Year: 1990, Month: 1, Day: 4}},
+		}, []int{2, 3}},
+		{"deleted", &userspb.UserFilter{Deleted: true}, []int{5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			emails, _ := list(tt.filter, 100)
+			if len(emails) != len(tt.want) {
+				t.Fatalf("got users %v, want %v", emails, tt.want)
+			}
+			for _, n := range tt.want {
+				if !emails[fmt.Sprintf("user%d@example.com", n)] {
+					t.Fatalf("user%d missing from %v", n, emails)
+				}
+			}
+		})
+	}
+
+	if emails, pages := list(nil, 2); len(emails) != 4 || pages != 2 {
+		t.Fatalf("paged through %d users on %d pages, want 4 on 2", len(emails), pages)
+	}
+
+	_, err := client.ListUsers(ctx, &userspb.ListUsersRequest{PageToken: "not base64!"})
+	assertCode(t, err, codes.InvalidArgument)
+
+	_, err = client.ListUsers(ctx, &userspb.ListUsersRequest{Filter: &userspb.UserFilter{
+		From: &userspb.UserFilter_BirthDateFrom{BirthDateFrom: &date.Date{Year: 2000, Month: 1, Day: 1}},
+		To:   &userspb.UserFilter_BirthDateTo{BirthDateTo: &date.Date{Year: 1990, Month: 1, Day: 1}},
+	}})
+	assertCode(t, err, codes.InvalidArgument)
+
+	// Negative page sizes are rejected even without the interceptor.
+	_, err = service.ListUsers(ctx, &userspb.ListUsersRequest{PageSize: -1})
+	assertCode(t, err, codes.InvalidArgument)
+}
+
+// watch opens a WatchUsers stream and returns it once the server has
+// subscribed, which it signals by sending the response headers.
+func watch(t *testing.T, client userspb.UsersClient, req *userspb.WatchUsersRequest) userspb.Users_WatchUsersClient {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	stream, err := client.WatchUsers(ctx, req)
+	if err != nil {
+		t.Fatalf("WatchUsers: %v", err)
+	}
+	if _, err := stream.Header(); err != nil {
+		t.Fatalf("WatchUsers headers: %v", err)
+	}
+	return stream
+}
+
+// nextEvent receives the next event from stream.
+func nextEvent(t *testing.T, stream userspb.Users_WatchUsersClient) *userspb.UserEvent {
+	t.Helper()
+
+	event, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	return event
+}
+
+func TestWatchUsers(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+	alice := createUser(t, client, 1)
+	bob := createUser(t, client, 2)
+
+	all := watch(t, client, &userspb.WatchUsersRequest{})
+	onlyAlice := watch(t, client, &userspb.WatchUsersRequest{Email: &alice.Email})
+
+	if _, err := client.UpdateUser(ctx, &userspb.UpdateUserRequest{Email: bob.GetEmail(), User: &userspb.UserUpdate{LastName: "Builder"}}); err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+	if _, err := client.BlockUser(ctx, &userspb.BlockUserRequest{Email: alice.GetEmail(), Reason: "x"}); err != nil {
+		t.Fatalf("BlockUser: %v", err)
+	}
+
+	updated := nextEvent(t, all)
+	if updated.GetType() != userspb.UserEventType_USER_UPDATED || updated.GetUser().GetLastName() != "Builder" || updated.GetCursor() == "" {
+		t.Fatalf("got event %v, want bob's update", updated)
+	}
+	if event := nextEvent(t, all); event.GetType() != userspb.UserEventType_USER_BLOCKED || event.GetUser().GetEmail() != alice.GetEmail() {
+		t.Fatalf("got event %v, want alice's block", event)
+	}
+
+	// The filtered stream skips bob's update.
+	if event := nextEvent(t, onlyAlice); event.GetType() != userspb.UserEventType_USER_BLOCKED {
+		t.Fatalf("got event %v on alice's stream, want her block", event)
+	}
+
+	// Resuming replays what followed the cursor.
+	resumed, err := client.WatchUsers(ctx, &userspb.WatchUsersRequest{Cursor: updated.GetCursor()})
+	if err != nil {
+		t.Fatalf("WatchUsers: %v", err)
+	}
+	replayed, err := resumed.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	if replayed.GetType() != userspb.UserEventType_USER_BLOCKED {
+		t.Fatalf("got replayed event %v, want alice's block", replayed)
+	}
+
+	tests := []struct {
+		name   string
+		cursor string
+		want   codes.Code
+	}{
+		{"other process", "0123456789abcdef.1", codes.FailedPrecondition},
+		{"before broker ids", "1", codes.FailedPrecondition},
+		{"malformed", "x.y", codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream, err := client.WatchUsers(ctx, &userspb.WatchUsersRequest{Cursor: tt.cursor})
+			if err != nil {
+				t.Fatalf("WatchUsers: %v", err)
+			}
+			_, err = stream.Recv()
+			assertCode(t, err, tt.want)
+		})
+	}
+}
+
+func TestWatchUsersOrdersEventsOfAUser(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+	user := createUser(t, client, 1)
+
+	stream := watch(t, client, &userspb.WatchUsersRequest{})
+
+	// Concurrent writers retry until each has applied one update.
+	const writers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				_, err := client.UpdateUser(ctx, &userspb.UpdateUserRequest{
+					Email: user.GetEmail(),
+					User:  &userspb.UserUpdate{LastName: fmt.Sprintf("Writer%d", i)},
+				})
+				if status.Code(err) != codes.FailedPrecondition {
+					if err != nil {
+						t.Errorf("UpdateUser: %v", err)
+					}
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for want := user.GetVersion() + 1; want <= user.GetVersion()+writers; want++ {
+		if event := nextEvent(t, stream); event.GetUser().GetVersion() != want {
+			t.Fatalf("got event for version %d, want %d", event.GetUser().GetVersion(), want)
+		}
+	}
+}
+
+func TestRestoreUser(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+	user := createUser(t, client, 1)
+
+	_, err := client.RestoreUser(ctx, &userspb.RestoreUserRequest{Email: user.GetEmail()})
+	assertCode(t, err, codes.NotFound)
+
+	if _, err := client.DeleteUser(ctx, &userspb.DeleteUserRequest{Email: user.GetEmail()}); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+
+	// The email stays taken while the user can be restored.
+	_, err = client.CreateUser(ctx, userRequest(1))
+	assertCode(t, err, codes.AlreadyExists)
+
+	stale := user.GetVersion()
+	_, err = client.RestoreUser(ctx, &userspb.RestoreUserRequest{Email: user.GetEmail(), ExpectedVersion: &stale})
+	assertCode(t, err, codes.FailedPrecondition)
+
+	restored, err := client.RestoreUser(ctx, &userspb.RestoreUserRequest{Email: user.GetEmail()})
+	if err != nil {
+		t.Fatalf("RestoreUser: %v", err)
+	}
+	if restored.GetDeletedAt() != nil || restored.GetDeletedBy() != "" {
+		t.Fatalf("got restored user %v", restored)
+	}
+}
+
+func TestPurgeDeletedUsers(t *testing.T) {
+	client, service := newTestService(t, testRetention)
+	clock := setTestClock(service)
+	ctx := context.Background()
+	user := createUser(t, client, 1)
+	kept := createUser(t, client, 2)
+
+	for _, email := range []string{user.GetEmail(), kept.GetEmail()} {
+		if _, err := client.DeleteUser(ctx, &userspb.DeleteUserRequest{Email: email}); err != nil {
+			t.Fatalf("DeleteUser: %v", err)
+		}
+	}
+	if _, err := client.RestoreUser(ctx, &userspb.RestoreUserRequest{Email: kept.GetEmail()}); err != nil {
+		t.Fatalf("RestoreUser: %v", err)
+	}
+
+	purged, err := service.PurgeDeletedUsers(ctx)
+	if err != nil {
+		t.Fatalf("PurgeDeletedUsers: %v", err)
+	}
+	if purged != 0 {
+		t.Fatalf("purged %d users within the retention, want 0", purged)
+	}
+
+	clock.Advance(testRetention)
+
+	// Past the retention the user can no longer be restored.
+	_, err = client.RestoreUser(ctx, &userspb.RestoreUserRequest{Email: user.GetEmail()})
+	assertCode(t, err, codes.FailedPrecondition)
+
+	purged, err = service.PurgeDeletedUsers(ctx)
+	if err != nil {
+		t.Fatalf("PurgeDeletedUsers: %v", err)
+	}
+	if purged != 1 {
+		t.Fatalf("purged %d users, want 1", purged)
+	}
+
+	// The purged user's email is free again and the restored user is kept.
+	createUser(t, client, 1)
+	if _, err := client.GetUser(ctx, &userspb.GetUserRequest{Email: &kept.Email}); err != nil {
+		t.Fatalf("GetUser(restored): %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	userspb "2k4sm/grpc-crud/proto/users"
+	"2k4sm/grpc-crud/src/convert"
+	"2k4sm/grpc-crud/src/email"
+	"2k4sm/grpc-crud/src/phone"
+
+	"buf.build/go/protovalidate"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/genproto/googleapis/type/date"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	dateLayout = "2006-01-02"
+	// legacyMidnight is the time of day the dob string used to be returned
+	// with. It is accepted on input so that older clients can send back what
+	// they were given.
+	legacyMidnight = "T00:00:00Z"
+)
+
+// badRequest collects the invalid fields of a request so that clients are told
+// about all of them at once and can attach each message to its form field.
+// Field names are proto field paths, e.g. "user.dob".
+type badRequest struct {
+	violations []*errdetails.BadRequest_FieldViolation
+}
+
+func (b *badRequest) add(field, description string) {
+	b.violations = append(b.violations, &errdetails.BadRequest_FieldViolation{
+		Field:       field,
+		Description: description,
+	})
+}
+
+// date parses value as a YYYY-MM-DD date and records a violation if it is not
+// one.
+func (b *badRequest) date(field, value string) time.Time {
+	parsed, err := time.Parse(dateLayout, strings.TrimSuffix(value, legacyMidnight))
+	if err != nil {
+		b.add(field, fmt.Sprintf("must be a date formatted as YYYY-MM-DD, got %q", value))
+	}
+	return parsed
+}
+
+// calendarDate converts value to midnight UTC of that day and records a
+// violation unless it is a complete, existing date.
+func (b *badRequest) calendarDate(field string, value *date.Date) time.Time {
+	parsed, err := convert.DateFromProto(value)
+	if err != nil {
+		b.add(field, fmt.Sprintf("must be a complete calendar date, got %04d-%02d-%02d", value.GetYear(), value.GetMonth(), value.GetDay()))
+	}
+	return parsed
+}
+
+// dateOfBirth reads a date of birth sent either as birth_date or as the
+// legacy dob string. prefix is the path of the message carrying them.
+func (b *badRequest) dateOfBirth(prefix string, birthDate *date.Date, dob string) time.Time {
+	if birthDate != nil {
+		return b.calendarDate(prefix+"birth_date", birthDate)
+	}
+	return b.date(prefix+"dob", dob)
+}
+
+// phone normalizes value to E.164 and records a violation if it is not a
+// phone number.
+func (b *badRequest) phone(phones *phone.Normalizer, field, value string) string {
+	normalized, err := phones.Normalize(value)
+	if err != nil {
+		b.add(field, fmt.Sprintf("must be a valid phone number, got %q", value))
+	}
+	return normalized
+}
+
+// email canonicalizes value and records a violation if it is not an email
+// address.
+func (b *badRequest) email(emails *email.Canonicalizer, field, value string) string {
+	canonical, err := emails.Canonicalize(value)
+	if err != nil {
+		b.add(field, fmt.Sprintf("must be a valid email address, got %q", value))
+	}
+	return canonical
+}
+
+// gender returns the stored form of value and records a violation if it has
+// none.
+func (b *badRequest) gender(field string, value userspb.Gender) string {
+	gender, err := convert.GenderFromProto(value)
+	if err != nil {
+		b.add(field, fmt.Sprintf("must be a known gender, got %d", value))
+	}
+	return gender
+}
+
+// optionalGender is gender for a field that may be left out, which means
+// GENDER_UNSPECIFIED.
+func (b *badRequest) optionalGender(field string, value *userspb.Gender) string {
+	if value == nil {
+		return b.gender(field, userspb.Gender_GENDER_UNSPECIFIED)
+	}
+	return b.gender(field, *value)
+}
+
+// access returns the stored form of value and records a violation if it has
+// none.
+func (b *badRequest) access(field string, value userspb.Access) string {
+	access, err := convert.AccessFromProto(value)
+	if err != nil {
+		b.add(field, fmt.Sprintf("must be a known access, got %d", value))
+	}
+	return access
+}
+
+// restriction returns the stored form of the access state a BlockUser request
+// moves a user to, BLOCKED when left out, and when that state ends, zero if
+// it lasts until UnblockUser. A suspension always ends, so SUSPENDED needs an
+// until; any until must lie in the future.
+func (b *badRequest) restriction(access userspb.Access, until *timestamppb.Timestamp, now time.Time) (string, time.Time) {
+	switch access {
+	case userspb.Access_ACCESS_UNSPECIFIED:
+		access = userspb.Access_BLOCKED
+	case userspb.Access_UNBLOCKED:
+		b.add("access", "must restrict the user, UNBLOCKED is set with UnblockUser")
+	}
+	stored := b.access("access", access)
+
+	var expiresAt time.Time
+	switch {
+	case until == nil:
+		if access == userspb.Access_SUSPENDED {
+			b.add("until", "is required with SUSPENDED")
+		}
+	case until.CheckValid() != nil:
+		b.add("until", fmt.Sprintf("must be a valid timestamp: %v", until.CheckValid()))
+	case !until.AsTime().After(now):
+		b.add("until", "must be in the future")
+	default:
+		// Stored timestamps keep milliseconds.
+		expiresAt = until.AsTime().UTC().Truncate(time.Millisecond)
+	}
+	return stored, expiresAt
+}
+
+// err returns an InvalidArgument status carrying an errdetails.BadRequest, or
+// nil if no violation was recorded.
+func (b *badRequest) err() error {
+	if len(b.violations) == 0 {
+		return nil
+	}
+
+	messages := make([]string, len(b.violations))
+	for i, violation := range b.violations {
+		messages[i] = strings.TrimSpace(violation.GetField() + " " + violation.GetDescription())
+	}
+
+	st := status.New(codes.InvalidArgument, "Invalid Input: "+strings.Join(messages, "; "))
+	detailed, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: b.violations})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+func invalidField(field, description string) error {
+	var violations badRequest
+	violations.add(field, description)
+	return violations.err()
+}
+
+// validateRequest checks msg against the buf.validate rules declared in
+// users.proto and reports every violation as a BadRequest field violation.
+func validateRequest(msg proto.Message) error {
+	err := protovalidate.Validate(msg)
+
+	var validationErr *protovalidate.ValidationError
+	if errors.As(err, &validationErr) {
+		var violations badRequest
+		for _, violation := range validationErr.Violations {
+			violations.add(
+				protovalidate.FieldPathString(violation.Proto.GetField()),
+				strings.TrimPrefix(violation.Proto.GetMessage(), "value "),
+			)
+		}
+		return violations.err()
+	}
+
+	if err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("Error validating request: %v", err))
+	}
+
+	return nil
+}
+
+// UnaryValidationInterceptor rejects requests that break the rules declared
+// in users.proto before they reach a handler.
+func UnaryValidationInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if msg, ok := req.(proto.Message); ok {
+		if err := validateRequest(msg); err != nil {
+			return nil, err
+		}
+	}
+	return handler(ctx, req)
+}
+
+// StreamValidationInterceptor applies the same rules to every message a
+// client sends on a stream.
+func StreamValidationInterceptor(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &validatingStream{ServerStream: stream})
+}
+
+type validatingStream struct {
+	grpc.ServerStream
+}
+
+func (s *validatingStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if msg, ok := m.(proto.Message); ok {
+		return validateRequest(msg)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"log"
+	"os"
+
+	"2k4sm/grpc-crud/src/db"
+	"2k4sm/grpc-crud/src/repositories"
+)
+
+// OpenUserRepository connects to the storage backend selected by
+// STORAGE_DRIVER and returns its UserRepository together with a function that
+// closes the connection.
+func OpenUserRepository() (repositories.UserRepository, func()) {
+	switch os.Getenv("STORAGE_DRIVER") {
+	case "memory":
+		log.Println("Using in-memory user storage, data is lost on restart")
+		return repositories.NewInMemoryUserRepository(), func() {}
+	case "sqlite":
+		dsn := os.Getenv("SQL_DSN")
+		if dsn == "" {
+			dsn = "grpc-crud.db"
+		}
+
+		sqlDb := db.InitSQLDb("sqlite", dsn)
+		return repositories.NewSQLUserRepository(sqlDb), func() { sqlDb.Close() }
+	case "postgres":
+		sqlDb := db.InitSQLDb("pgx", os.Getenv("SQL_DSN"))
+		return repositories.NewSQLUserRepository(sqlDb), func() { sqlDb.Close() }
+	default:
+		session := db.InitDb()
+
+		if os.Getenv("MIGRATE_LEGACY_USERS") == "true" {
+			if err := db.MigrateLegacyUsers(session); err != nil {
+				log.Fatalln("Failed to migrate legacy users:", err)
+			}
+		}
+
+		return repositories.NewUserRepository(session), session.Close
+	}
+}